@@ -2,63 +2,100 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
 	"github.com/joho/godotenv"
 
 	"vigilant-uptime-outpost/internal/checks"
 	"vigilant-uptime-outpost/internal/config"
+	"vigilant-uptime-outpost/internal/egress"
 	"vigilant-uptime-outpost/internal/httpserver"
+	"vigilant-uptime-outpost/internal/logging"
+	"vigilant-uptime-outpost/internal/puller"
 	"vigilant-uptime-outpost/internal/registrar"
+	"vigilant-uptime-outpost/internal/version"
 )
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("No .env file found")
+	envErr := godotenv.Load()
+	logging.Setup(config.LogLevel(), config.LogFormat())
+	if envErr != nil {
+		slog.Info("no .env file found")
 	}
+	slog.Info("starting outpost", "version", version.Version)
 	cfg := config.Load()
 
 	reg := registrar.New(cfg)
-	checker := checks.New(reg)
-	server := httpserver.New(cfg, checker, reg)
+	policy, err := egress.NewPolicy(cfg.EgressBlockPrivate, cfg.EgressAllowCIDRs, cfg.EgressDenyCIDRs, cfg.EgressAllowHosts, cfg.EgressDenyHosts)
+	if err != nil {
+		slog.Error("invalid egress policy", "error", err)
+		os.Exit(1)
+	}
+	policy.TrustProxies = cfg.EgressTrustProxies
+	checker := checks.New(reg, checks.Limits{
+		MaxConcurrency: cfg.MaxConcurrency,
+		QueueSize:      cfg.QueueSize,
+		PerType:        cfg.TypeConcurrency,
+	}, policy)
+	reg.SetStatsProvider(checker.Stats)
+	reg.SetCapabilities(checks.Capabilities(cfg.MaxConcurrency))
+	server := httpserver.New(cfg, checker, reg, policy)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	if err := reg.Register(ctx); err != nil {
-		log.Printf("registration failed: %v", err)
+		slog.Error("registration failed", "error", err)
 		os.Exit(1)
 	}
 
+	go reg.RunCertificateRenewal(ctx)
+	go reg.RunHeartbeat(ctx)
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		if err := server.Start(); err != nil && err != http.ErrServerClosed {
-			log.Printf("server error: %v", err)
-			sig <- syscall.SIGTERM
-		}
-	}()
+	pullerDone := make(chan struct{})
+	if cfg.Mode == config.ModePull {
+		// Vigilant cannot reach the outpost, poll it for jobs instead
+		go func() {
+			puller.New(cfg, checker, reg).Run(ctx)
+			close(pullerDone)
+		}()
+	} else {
+		close(pullerDone)
+		go func() {
+			if err := server.Start(); err != nil && err != http.ErrServerClosed {
+				slog.Error("server error", "error", err)
+				sig <- syscall.SIGTERM
+			}
+		}()
+	}
 
 	select {
 	case <-sig:
-		log.Println("received shutdown signal")
+		slog.Info("received shutdown signal")
 	case <-server.GetShutdownChan():
-		log.Println("inactivity timeout reached")
+		slog.Info("inactivity timeout reached")
 	}
 	cancel()
-	
-	log.Println("shutting down outpost...")
-	
+
+	slog.Info("shutting down outpost")
+
+	// The puller stops polling right away and bounds how long running
+	// jobs may take to report their results
+	<-pullerDone
+
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
-	
+
 	if err := reg.Unregister(shutdownCtx); err != nil {
-		log.Printf("unregister error: %v", err)
+		slog.Error("unregister failed", "error", err)
 	}
-	
+
 	server.Stop()
-	log.Println("outpost stopped")
+	slog.Info("outpost stopped")
 }
@@ -1,5 +1,17 @@
 module vigilant-uptime-outpost
 
-go 1.24
+go 1.24.0
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/joho/godotenv v1.5.1
+	github.com/miekg/dns v1.1.72
+	golang.org/x/crypto v0.46.0
+	golang.org/x/net v0.48.0
+)
+
+require (
+	golang.org/x/mod v0.31.0 // indirect
+	golang.org/x/sync v0.19.0 // indirect
+	golang.org/x/sys v0.39.0 // indirect
+	golang.org/x/tools v0.40.0 // indirect
+)
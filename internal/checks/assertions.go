@@ -0,0 +1,231 @@
+package checks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxBodyBytes bounds how much of a response body is read.
+const maxBodyBytes = 1 << 20
+
+type HTTPAssertions struct {
+	StatusCodes       []int               `json:"status_codes,omitempty"`
+	Contains          []string            `json:"contains,omitempty"`
+	NotContains       []string            `json:"not_contains,omitempty"`
+	Regex             []string            `json:"regex,omitempty"`
+	JSONPath          []JSONPathAssertion `json:"json_path,omitempty"`
+	Headers           map[string]string   `json:"headers,omitempty"`
+	MaxResponseTimeMS float64             `json:"max_response_time_ms,omitempty"`
+}
+
+type JSONPathAssertion struct {
+	Path string `json:"path"`
+	// Operator is one of eq (default), ne, gt, gte, lt, lte, contains, exists or not_exists
+	Operator string `json:"operator,omitempty"`
+	Value    any    `json:"value,omitempty"`
+}
+
+// statusOK reports whether the status code is acceptable, falling back to
+// the 2xx/3xx range when no status codes are asserted.
+func (a *HTTPAssertions) statusOK(code int) bool {
+	if a == nil || len(a.StatusCodes) == 0 {
+		return code >= 200 && code < 400
+	}
+	return slices.Contains(a.StatusCodes, code)
+}
+
+// evaluate runs every assertion and returns a description of each failure.
+func (a *HTTPAssertions) evaluate(resp *http.Response, body []byte, truncated bool, latencyMS float64) []string {
+	if a == nil {
+		return nil
+	}
+
+	var failed []string
+	if len(a.StatusCodes) > 0 && !a.statusOK(resp.StatusCode) {
+		failed = append(failed, fmt.Sprintf("status code %d not in %v", resp.StatusCode, a.StatusCodes))
+	}
+
+	if a.MaxResponseTimeMS > 0 && latencyMS > a.MaxResponseTimeMS {
+		failed = append(failed, fmt.Sprintf("response time %.0fms exceeds %.0fms", latencyMS, a.MaxResponseTimeMS))
+	}
+
+	for name, expected := range a.Headers {
+		values := resp.Header.Values(name)
+		if len(values) == 0 {
+			failed = append(failed, fmt.Sprintf("header %q missing", name))
+			continue
+		}
+		if expected != "" && !slices.Contains(values, expected) {
+			failed = append(failed, fmt.Sprintf("header %q is %q, expected %q", name, strings.Join(values, ", "), expected))
+		}
+	}
+
+	for _, s := range a.Contains {
+		if !bytes.Contains(body, []byte(s)) {
+			failed = append(failed, fmt.Sprintf("body does not contain %q", s))
+		}
+	}
+
+	for _, s := range a.NotContains {
+		if bytes.Contains(body, []byte(s)) {
+			failed = append(failed, fmt.Sprintf("body contains %q", s))
+		}
+	}
+
+	for _, pattern := range a.Regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("invalid regex %q: %v", pattern, err))
+			continue
+		}
+		if !re.Match(body) {
+			failed = append(failed, fmt.Sprintf("body does not match %q", pattern))
+		}
+	}
+
+	if len(a.JSONPath) > 0 {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			msg := fmt.Sprintf("body is not valid JSON: %v", err)
+			if truncated {
+				msg = fmt.Sprintf("body exceeds %d bytes and could not be parsed as JSON", maxBodyBytes)
+			}
+			failed = append(failed, msg)
+		} else {
+			for _, assertion := range a.JSONPath {
+				if err := assertion.evaluate(doc); err != nil {
+					failed = append(failed, err.Error())
+				}
+			}
+		}
+	}
+
+	return failed
+}
+
+func (a JSONPathAssertion) evaluate(doc any) error {
+	values, err := evalJSONPath(doc, a.Path)
+	if err != nil {
+		return err
+	}
+
+	op := strings.ToLower(a.Operator)
+	if op == "" {
+		op = "eq"
+	}
+
+	switch op {
+	case "exists":
+		if len(values) == 0 {
+			return fmt.Errorf("%s does not exist", a.Path)
+		}
+		return nil
+	case "not_exists":
+		if len(values) > 0 {
+			return fmt.Errorf("%s exists", a.Path)
+		}
+		return nil
+	}
+
+	if len(values) == 0 {
+		return fmt.Errorf("%s does not exist", a.Path)
+	}
+
+	// With wildcards the assertion passes when any matched value satisfies it
+	for _, v := range values {
+		ok, err := compareJSONValue(op, v, a.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.Path, err)
+		}
+		if ok {
+			return nil
+		}
+	}
+	if len(values) == 1 {
+		return fmt.Errorf("%s is %s, expected %s %s", a.Path, formatJSONValue(values[0]), op, formatJSONValue(a.Value))
+	}
+	return fmt.Errorf("no value of %s is %s %s", a.Path, op, formatJSONValue(a.Value))
+}
+
+func compareJSONValue(op string, actual, expected any) (bool, error) {
+	switch op {
+	case "eq":
+		return reflect.DeepEqual(actual, expected), nil
+	case "ne":
+		return !reflect.DeepEqual(actual, expected), nil
+	case "contains":
+		switch v := actual.(type) {
+		case string:
+			s, ok := expected.(string)
+			return ok && strings.Contains(v, s), nil
+		case []any:
+			for _, item := range v {
+				if reflect.DeepEqual(item, expected) {
+					return true, nil
+				}
+			}
+			return false, nil
+		default:
+			return false, nil
+		}
+	case "gt", "gte", "lt", "lte":
+		a, aok := jsonNumber(actual)
+		e, eok := jsonNumber(expected)
+		if !aok || !eok {
+			return false, nil
+		}
+		switch op {
+		case "gt":
+			return a > e, nil
+		case "gte":
+			return a >= e, nil
+		case "lt":
+			return a < e, nil
+		default:
+			return a <= e, nil
+		}
+	default:
+		return false, fmt.Errorf("unknown operator %q", op)
+	}
+}
+
+func jsonNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func formatJSONValue(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// readBody reads at most maxBodyBytes of the body and reports whether the
+// body was larger than that.
+func readBody(r io.Reader) ([]byte, bool, error) {
+	body, err := io.ReadAll(io.LimitReader(r, maxBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxBodyBytes {
+		return body[:maxBodyBytes], true, nil
+	}
+	return body, false, nil
+}
@@ -0,0 +1,54 @@
+package checks
+
+import (
+	"net"
+
+	"vigilant-uptime-outpost/internal/registrar"
+	"vigilant-uptime-outpost/internal/version"
+)
+
+// Capabilities detects what this outpost can check, for advertising to
+// Vigilant at registration.
+func Capabilities(maxConcurrency int) registrar.Capabilities {
+	types := Types()
+	infos := make([]registrar.CheckTypeInfo, 0, len(types))
+	for _, t := range types {
+		infos = append(infos, registrar.CheckTypeInfo{
+			Type:        t.Type,
+			Description: t.Description,
+			Options:     t.Options,
+		})
+	}
+
+	return registrar.Capabilities{
+		Version:        version.Version,
+		CheckTypes:     infos,
+		IPv4:           hasRoute("udp4", "8.8.8.8:53"),
+		IPv6:           hasRoute("udp6", "[2001:4860:4860::8888]:53"),
+		ICMP:           icmpAvailable(),
+		MaxConcurrency: maxConcurrency,
+	}
+}
+
+// hasRoute reports whether the host has a route to the given public
+// address. Connecting a UDP socket does not send any packets.
+func hasRoute(network, address string) bool {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// icmpAvailable reports whether an ICMP socket can be opened, either
+// unprivileged or raw.
+func icmpAvailable() bool {
+	for _, isV6 := range []bool{false, true} {
+		if conn, _, err := listenICMP(isV6); err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return false
+}
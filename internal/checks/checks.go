@@ -2,19 +2,36 @@ package checks
 
 import (
 	"context"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
+	"vigilant-uptime-outpost/internal/egress"
+	"vigilant-uptime-outpost/internal/logging"
+	"vigilant-uptime-outpost/internal/metrics"
 	"vigilant-uptime-outpost/internal/registrar"
 )
 
 type Job struct {
-	Type        string            `json:"type"`
-	Target      string            `json:"target"`
-	Method      string            `json:"method,omitempty"`
-	Headers     map[string]string `json:"headers,omitempty"`
-	Body        string            `json:"body,omitempty"`
-	Timeout     int               `json:"timeout,omitempty"`
-	CallbackURL string            `json:"callback_url,omitempty"`
+	ID          string             `json:"id,omitempty"`
+	Type        string             `json:"type"`
+	Target      string             `json:"target"`
+	Method      string             `json:"method,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`
+	Body        string             `json:"body,omitempty"`
+	Timeout     int                `json:"timeout,omitempty"`
+	CallbackURL string             `json:"callback_url,omitempty"`
+	VerifyTLS   bool               `json:"verify_tls,omitempty"`
+	Assertions  *HTTPAssertions    `json:"assertions,omitempty"`
+	Redirects   *RedirectOptions   `json:"redirects,omitempty"`
+	HTTPClient  *HTTPClientOptions `json:"http_client,omitempty"`
+	DNS         *DNSOptions        `json:"dns,omitempty"`
+	TLS         *TLSOptions        `json:"tls,omitempty"`
+	ICMP        *ICMPOptions       `json:"icmp,omitempty"`
+	Traceroute  *TracerouteOptions `json:"traceroute,omitempty"`
+	TCP         *TCPOptions        `json:"tcp,omitempty"`
+	UDP         *UDPOptions        `json:"udp,omitempty"`
+	HTTPFlow    *HTTPFlowOptions   `json:"http_flow,omitempty"`
 }
 
 const defaultTimeoutSeconds = 5
@@ -31,36 +48,162 @@ func jobTimeoutDuration(job Job) time.Duration {
 }
 
 type Result struct {
-	Outpost    registrar.Registration `json:"outpost"`
-	Type       string              `json:"type"`
-	Target     string              `json:"target"`
-	Up         bool                `json:"up"`
-	LatencyMS  float64             `json:"latency_ms"`
-	StatusCode int                 `json:"status_code,omitempty"`
-	Error      string              `json:"error,omitempty"`
-	Timestamp  time.Time           `json:"timestamp"`
+	Outpost          registrar.Registration `json:"outpost"`
+	JobID            string                 `json:"job_id,omitempty"`
+	Pending          bool                   `json:"pending,omitempty"`
+	Type             string                 `json:"type"`
+	Target           string                 `json:"target"`
+	Up               bool                   `json:"up"`
+	LatencyMS        float64                `json:"latency_ms"`
+	StatusCode       int                    `json:"status_code,omitempty"`
+	Error            string                 `json:"error,omitempty"`
+	DNS              *DNSResult             `json:"dns,omitempty"`
+	Certificate      *CertificateInfo       `json:"certificate,omitempty"`
+	Timings          *HTTPTimings           `json:"timings,omitempty"`
+	Redirects        []RedirectHop          `json:"redirects,omitempty"`
+	FinalURL         string                 `json:"final_url,omitempty"`
+	ICMP             *ICMPStats             `json:"icmp,omitempty"`
+	Hops             []TracerouteHop        `json:"hops,omitempty"`
+	Steps            []HTTPFlowStepResult   `json:"steps,omitempty"`
+	Response         string                 `json:"response,omitempty"`
+	FailedAssertions []string               `json:"failed_assertions,omitempty"`
+	QueueWaitMS      float64                `json:"queue_wait_ms,omitempty"`
+	Timestamp        time.Time              `json:"timestamp"`
 }
 
+var (
+	checksTotal    = metrics.NewCounterVec("outpost_checks_total", "Checks run by type and outcome (up, down or error).", "type", "outcome")
+	checkDuration  = metrics.NewHistogramVec("outpost_check_duration_seconds", "Duration of checks by type.", metrics.DefaultBuckets, "type")
+	checksInFlight = metrics.NewGauge("outpost_checks_in_flight", "Checks currently running.")
+)
+
 type Checker struct {
-	reg registrar.Registration
+	env          *Env
+	limiter      *limiter
+	inFlight     atomic.Int64
+	checksRun    atomic.Int64
+	checksFailed atomic.Int64
+	checkErrors  atomic.Int64
+}
+
+// New returns a Checker running checks within the given limits and
+// connecting only to targets allowed by the egress policy.
+func New(reg *registrar.Registrar, limits Limits, policy *egress.Policy) *Checker {
+	return &Checker{
+		env:     newEnv(reg.Info(), policy),
+		limiter: newLimiter(limits),
+	}
+}
+
+// Admit reserves room in the queue for n checks, which must then each be
+// passed to Run. It returns ErrQueueFull, reserving nothing, when the queue
+// cannot hold all of them.
+func (c *Checker) Admit(n int) error {
+	return c.limiter.admit(n)
+}
+
+// Release gives back the room reserved for n admitted checks that will not
+// be passed to Run.
+func (c *Checker) Release(n int) {
+	for range n {
+		c.limiter.done()
+	}
 }
 
-func New(reg *registrar.Registrar) *Checker {
-	return &Checker{reg: reg.Info()}
+// Capacity returns the number of checks that can be admitted at once, the
+// most a single batch can hold.
+func (c *Checker) Capacity() int {
+	return c.limiter.capacity
 }
 
+// Run dispatches an admitted job to the runner registered for its type once
+// a slot is free. The time spent waiting is reported as QueueWaitMS,
+// separately from the check latency.
 func (c *Checker) Run(ctx context.Context, job Job) Result {
-	switch job.Type {
-	case "http":
-		return runHTTP(ctx, c.reg, job)
-	case "tcp":
-		return runTCP(ctx, c.reg, job)
-	case "icmp":
-		return runICMP(ctx, c.reg, job)
-	default:
+	defer c.limiter.done()
+	if job.ID != "" {
+		ctx = logging.WithJobID(ctx, job.ID)
+	}
+
+	wait, release, err := c.limiter.acquire(ctx, job.Type)
+	if err != nil {
+		return Result{
+			Outpost: c.env.Outpost, JobID: job.ID, Type: job.Type, Target: job.Target,
+			Error: err.Error(), QueueWaitMS: durationMS(wait), Timestamp: time.Now().UTC(),
+		}
+	}
+	defer release()
+
+	c.inFlight.Add(1)
+	checksInFlight.Inc()
+	defer func() {
+		c.inFlight.Add(-1)
+		checksInFlight.Dec()
+	}()
+
+	start := time.Now()
+	result := c.run(ctx, job)
+	observeCheck(job.Type, result, time.Since(start))
+	slog.DebugContext(ctx, "check finished",
+		"type", job.Type,
+		"target", job.Target,
+		"up", result.Up,
+		"latency_ms", result.LatencyMS,
+		"error", result.Error,
+	)
+	if job.ID != "" {
+		result.JobID = job.ID
+	}
+	result.QueueWaitMS = durationMS(wait)
+
+	c.checksRun.Add(1)
+	if !result.Up {
+		c.checksFailed.Add(1)
+	}
+	if result.Error != "" {
+		c.checkErrors.Add(1)
+	}
+	return result
+}
+
+func durationMS(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+// observeCheck records the outcome and duration of a check. Unregistered
+// types share a single label to keep the number of series bounded.
+func observeCheck(checkType string, result Result, dur time.Duration) {
+	if _, ok := lookupRunner(checkType); !ok {
+		checkType = "unknown"
+	}
+	outcome := "up"
+	switch {
+	case result.Error != "":
+		outcome = "error"
+	case !result.Up:
+		outcome = "down"
+	}
+	checksTotal.Inc(checkType, outcome)
+	checkDuration.Observe(dur.Seconds(), checkType)
+}
+
+func (c *Checker) run(ctx context.Context, job Job) Result {
+	runner, ok := lookupRunner(job.Type)
+	if !ok {
 		return Result{
-			Outpost: c.reg, Type: job.Type, Target: job.Target,
+			Outpost: c.env.Outpost, Type: job.Type, Target: job.Target,
 			Error: "unknown check type",
 		}
 	}
+	return runner.Run(ctx, c.env, job)
+}
+
+// Stats returns the counters reported in heartbeats.
+func (c *Checker) Stats() registrar.CheckStats {
+	return registrar.CheckStats{
+		InFlight: c.inFlight.Load(),
+		Run:      c.checksRun.Load(),
+		Failed:   c.checksFailed.Load(),
+		Errors:   c.checkErrors.Load(),
+	}
 }
@@ -0,0 +1,260 @@
+package checks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"vigilant-uptime-outpost/internal/egress"
+)
+
+func init() {
+	Register("dns", "Resolves a name and checks the returned records", dnsOptionsSchema, CheckRunnerFunc(runDNS))
+}
+
+const dnsOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "name to resolve"},
+		"dns": {
+			"type": "object",
+			"properties": {
+				"record_type": {"enum": ["A", "AAAA", "CNAME", "MX", "TXT", "NS", "SOA", "CAA", "SRV"], "default": "A"},
+				"server": {"type": "string", "description": "resolver as host or host:port, the system resolver when empty"},
+				"protocol": {"enum": ["udp", "tcp"], "default": "udp"},
+				"expected": {"type": "array", "items": {"type": "string"}},
+				"expected_rcode": {"type": "string", "default": "NOERROR"}
+			}
+		}
+	}
+}`
+
+const resolvConfPath = "/etc/resolv.conf"
+
+var dnsRecordTypes = map[string]uint16{
+	"A":     dns.TypeA,
+	"AAAA":  dns.TypeAAAA,
+	"CNAME": dns.TypeCNAME,
+	"MX":    dns.TypeMX,
+	"TXT":   dns.TypeTXT,
+	"NS":    dns.TypeNS,
+	"SOA":   dns.TypeSOA,
+	"CAA":   dns.TypeCAA,
+	"SRV":   dns.TypeSRV,
+}
+
+type DNSOptions struct {
+	// RecordType is one of A, AAAA, CNAME, MX, TXT, NS, SOA, CAA or SRV (default A)
+	RecordType string `json:"record_type,omitempty"`
+	// Server is the resolver as host or host:port; empty uses the system resolver
+	Server string `json:"server,omitempty"`
+	// Protocol is udp (default) or tcp
+	Protocol string `json:"protocol,omitempty"`
+	// Expected lists values that must all be present in the answer
+	Expected []string `json:"expected,omitempty"`
+	// ExpectedRcode is the response code the check expects (default NOERROR)
+	ExpectedRcode string `json:"expected_rcode,omitempty"`
+}
+
+type DNSRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	TTL   uint32 `json:"ttl"`
+	Value string `json:"value"`
+}
+
+type DNSResult struct {
+	Resolver string      `json:"resolver"`
+	Rcode    string      `json:"rcode"`
+	Records  []DNSRecord `json:"records"`
+}
+
+func runDNS(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+	opts := DNSOptions{}
+	if job.DNS != nil {
+		opts = *job.DNS
+	}
+
+	recordType := strings.ToUpper(strings.TrimSpace(opts.RecordType))
+	if recordType == "" {
+		recordType = "A"
+	}
+	qtype, ok := dnsRecordTypes[recordType]
+	if !ok {
+		return fail(job, reg, fmt.Errorf("unsupported record type: %q", opts.RecordType))
+	}
+
+	protocol := strings.ToLower(opts.Protocol)
+	if protocol == "" {
+		protocol = "udp"
+	}
+	if protocol != "udp" && protocol != "tcp" {
+		return fail(job, reg, fmt.Errorf("unsupported protocol: %q", opts.Protocol))
+	}
+
+	name := strings.TrimSpace(job.Target)
+	if name == "" {
+		return fail(job, reg, fmt.Errorf("target is required"))
+	}
+
+	server, err := dnsServer(opts.Server)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	timeout := jobTimeoutDuration(job)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The system resolver is trusted, resolvers given by the job are not
+	if strings.TrimSpace(opts.Server) != "" {
+		if server, err = allowedServer(reqCtx, env.Egress, server); err != nil {
+			return fail(job, reg, err)
+		}
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, false)
+
+	client := &dns.Client{Net: protocol, Timeout: timeout}
+	resp, rtt, err := client.ExchangeContext(reqCtx, msg, server)
+	if err == nil && resp.Truncated && protocol == "udp" {
+		// Retry over TCP to get the full answer
+		client.Net = "tcp"
+		resp, rtt, err = client.ExchangeContext(reqCtx, msg, server)
+	}
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	dnsResult := &DNSResult{
+		Resolver: server,
+		Rcode:    dns.RcodeToString[resp.Rcode],
+		Records:  make([]DNSRecord, 0, len(resp.Answer)),
+	}
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		dnsResult.Records = append(dnsResult.Records, DNSRecord{
+			Name:  hdr.Name,
+			Type:  dns.TypeToString[hdr.Rrtype],
+			TTL:   hdr.Ttl,
+			Value: dnsRecordValue(rr),
+		})
+	}
+
+	result := Result{
+		Outpost:   reg,
+		Type:      job.Type,
+		Target:    job.Target,
+		LatencyMS: float64(rtt) / float64(time.Millisecond),
+		DNS:       dnsResult,
+		Timestamp: time.Now().UTC(),
+	}
+
+	if err := checkDNSAnswer(opts, dnsResult); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Up = true
+	return result
+}
+
+// dnsServer resolves the resolver address to query, defaulting to the first
+// nameserver of the system configuration.
+func dnsServer(server string) (string, error) {
+	server = strings.TrimSpace(server)
+	if server == "" {
+		conf, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read system resolver: %w", err)
+		}
+		if len(conf.Servers) == 0 {
+			return "", fmt.Errorf("no system resolver configured")
+		}
+		return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+	}
+
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server, nil
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), "53"), nil
+}
+
+// allowedServer resolves the resolver address with the egress policy and
+// returns the first allowed address.
+func allowedServer(ctx context.Context, policy *egress.Policy, server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", err
+	}
+	ips, err := policy.Resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+func dnsRecordValue(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	case *dns.CNAME:
+		return v.Target
+	case *dns.MX:
+		return strconv.Itoa(int(v.Preference)) + " " + v.Mx
+	case *dns.TXT:
+		return strings.Join(v.Txt, "")
+	case *dns.NS:
+		return v.Ns
+	case *dns.SOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)
+	case *dns.CAA:
+		return fmt.Sprintf("%d %s %q", v.Flag, v.Tag, v.Value)
+	case *dns.SRV:
+		return fmt.Sprintf("%d %d %d %s", v.Priority, v.Weight, v.Port, v.Target)
+	default:
+		// Strip the header from the presentation format
+		return strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+}
+
+func checkDNSAnswer(opts DNSOptions, res *DNSResult) error {
+	expectedRcode := strings.ToUpper(strings.TrimSpace(opts.ExpectedRcode))
+	if expectedRcode == "" {
+		expectedRcode = "NOERROR"
+	}
+	if res.Rcode != expectedRcode {
+		return fmt.Errorf("expected rcode %s, got %s", expectedRcode, res.Rcode)
+	}
+	if expectedRcode == "NOERROR" && len(res.Records) == 0 {
+		return fmt.Errorf("no records returned")
+	}
+
+	for _, expected := range opts.Expected {
+		found := false
+		for _, record := range res.Records {
+			if normalizeDNSValue(record.Value) == normalizeDNSValue(expected) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("expected record %q not found", expected)
+		}
+	}
+	return nil
+}
+
+func normalizeDNSValue(value string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(value), "."))
+}
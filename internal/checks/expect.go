@@ -0,0 +1,130 @@
+package checks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxResponseBytes bounds how much of a TCP or UDP response is read
+	maxResponseBytes = 64 << 10
+	// maxReportedBytes bounds how much of the response is included in the result
+	maxReportedBytes = 1024
+)
+
+// ExchangeOptions describe a payload to send to a socket and the response
+// that is expected back.
+type ExchangeOptions struct {
+	Send          string `json:"send,omitempty"`
+	SendHex       string `json:"send_hex,omitempty"`
+	Expect        string `json:"expect,omitempty"`
+	ExpectRegex   string `json:"expect_regex,omitempty"`
+	ExpectHex     string `json:"expect_hex,omitempty"`
+	ReadTimeoutMS int    `json:"read_timeout_ms,omitempty"`
+}
+
+// payload returns the bytes to send, decoding send_hex when set.
+func (o *ExchangeOptions) payload() ([]byte, error) {
+	if o == nil {
+		return nil, nil
+	}
+	if o.SendHex != "" {
+		b, err := decodeHex(o.SendHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid send_hex: %w", err)
+		}
+		return b, nil
+	}
+	return []byte(o.Send), nil
+}
+
+func (o *ExchangeOptions) expectsResponse() bool {
+	return o != nil && (o.Expect != "" || o.ExpectRegex != "" || o.ExpectHex != "")
+}
+
+// readTimeout returns the configured read deadline, bounded by the time
+// remaining for the check.
+func (o *ExchangeOptions) readTimeout(remaining time.Duration) time.Duration {
+	if o == nil || o.ReadTimeoutMS <= 0 {
+		return remaining
+	}
+	return min(time.Duration(o.ReadTimeoutMS)*time.Millisecond, remaining)
+}
+
+// responseMatcher checks responses against the compiled expectations.
+type responseMatcher struct {
+	substring []byte
+	pattern   *regexp.Regexp
+	raw       []byte
+}
+
+func (o *ExchangeOptions) matcher() (*responseMatcher, error) {
+	m := &responseMatcher{}
+	if !o.expectsResponse() {
+		return m, nil
+	}
+	if o.Expect != "" {
+		m.substring = []byte(o.Expect)
+	}
+	if o.ExpectRegex != "" {
+		re, err := regexp.Compile(o.ExpectRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect_regex: %w", err)
+		}
+		m.pattern = re
+	}
+	if o.ExpectHex != "" {
+		b, err := decodeHex(o.ExpectHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expect_hex: %w", err)
+		}
+		m.raw = b
+	}
+	return m, nil
+}
+
+// match returns nil when the response satisfies every expectation.
+func (m *responseMatcher) match(resp []byte) error {
+	if m.substring != nil && !bytes.Contains(resp, m.substring) {
+		return fmt.Errorf("response does not contain %q", m.substring)
+	}
+	if m.pattern != nil && !m.pattern.Match(resp) {
+		return fmt.Errorf("response does not match %q", m.pattern.String())
+	}
+	if m.raw != nil && !bytes.Contains(resp, m.raw) {
+		return fmt.Errorf("response does not contain bytes %s", hex.EncodeToString(m.raw))
+	}
+	return nil
+}
+
+func (m *responseMatcher) empty() bool {
+	return m.substring == nil && m.pattern == nil && m.raw == nil
+}
+
+// decodeHex decodes hex strings, ignoring whitespace, colons and a 0x prefix.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	s = strings.NewReplacer(" ", "", ":", "", "\n", "", "\t", "").Replace(s)
+	if s == "" {
+		return nil, errors.New("empty value")
+	}
+	return hex.DecodeString(s)
+}
+
+// formatResponse renders a response for the result, hex encoding binary
+// data and truncating long responses.
+func formatResponse(resp []byte) string {
+	if len(resp) > maxReportedBytes {
+		resp = resp[:maxReportedBytes]
+	}
+	if utf8.Valid(resp) {
+		return string(resp)
+	}
+	return hex.EncodeToString(resp)
+}
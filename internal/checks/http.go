@@ -3,54 +3,229 @@ package checks
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"vigilant-uptime-outpost/internal/egress"
 	"vigilant-uptime-outpost/internal/registrar"
 )
 
-var httpClient = &http.Client{
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+func init() {
+	Register("http", "Requests a URL and checks the response status, body, headers and timing", httpOptionsSchema, CheckRunnerFunc(runHTTP))
+}
+
+const httpOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "format": "uri", "description": "URL to request"},
+		"method": {"type": "string", "default": "GET"},
+		"headers": {"type": "object", "additionalProperties": {"type": "string"}},
+		"body": {"type": "string"},
+		"verify_tls": {"type": "boolean", "default": false},
+		"http_client": {
+			"type": "object",
+			"properties": {
+				"proxy": {"type": "string", "format": "uri", "description": "http, https, socks5 or socks5h proxy URL"},
+				"client_cert": {"type": "string", "description": "PEM encoded client certificate"},
+				"client_key": {"type": "string", "description": "PEM encoded client private key"},
+				"ca_bundle": {"type": "string", "description": "PEM encoded certificates trusted when verify_tls is set"},
+				"server_name": {"type": "string", "description": "SNI and certificate name override"},
+				"http_version": {"enum": ["1.1", "2"]},
+				"disable_keep_alives": {"type": "boolean", "default": false},
+				"auth": {
+					"type": "object",
+					"required": ["username", "password"],
+					"properties": {
+						"type": {"enum": ["basic", "digest"], "default": "basic"},
+						"username": {"type": "string"},
+						"password": {"type": "string"}
+					}
+				}
+			}
+		},
+		"redirects": {
+			"type": "object",
+			"properties": {
+				"follow": {"type": "boolean", "default": true},
+				"max_redirects": {"type": "integer", "default": 10},
+				"final_url": {"type": "string"},
+				"final_url_regex": {"type": "string"}
+			}
+		},
+		"assertions": {
+			"type": "object",
+			"properties": {
+				"status_codes": {"type": "array", "items": {"type": "integer"}},
+				"contains": {"type": "array", "items": {"type": "string"}},
+				"not_contains": {"type": "array", "items": {"type": "string"}},
+				"regex": {"type": "array", "items": {"type": "string"}},
+				"json_path": {
+					"type": "array",
+					"items": {
+						"type": "object",
+						"required": ["path"],
+						"properties": {
+							"path": {"type": "string"},
+							"operator": {"enum": ["eq", "ne", "gt", "gte", "lt", "lte", "contains", "exists", "not_exists"], "default": "eq"},
+							"value": {}
+						}
+					}
+				},
+				"headers": {"type": "object", "additionalProperties": {"type": "string"}},
+				"max_response_time_ms": {"type": "number"}
+			}
+		}
+	}
+}`
+
+// maxRedirects matches the limit of the default http.Client
+const maxRedirects = 10
+
+// newHTTPClient returns a client connecting through the egress policy. A
+// nil tlsConfig verifies certificates, checks opt in to verification
+// through verify_tls.
+func newHTTPClient(policy *egress.Policy, tlsConfig *tls.Config) *http.Client {
+	transport := &http.Transport{
+		DialContext: policy.DialContext(&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		TLSClientConfig: tlsConfig,
+		// Verifying clients negotiate HTTP/2 like the default transport
+		ForceAttemptHTTP2: tlsConfig == nil,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		// Redirect targets are checked before following them, their
+		// addresses are checked again when dialing
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if err := policy.CheckHost(req.URL.Hostname()); err != nil {
+				return fmt.Errorf("redirect to %s: %w", req.URL.Redacted(), err)
+			}
+			return nil
 		},
-	},
+	}
+}
+
+func runHTTP(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+
+	client, err := env.client(job.VerifyTLS, job.HTTPClient)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	chain := newRedirectChain(job.Redirects)
+	ex, err := doHTTP(ctx, chain.client(client), httpRequest{
+		Method:  job.Method,
+		URL:     job.Target,
+		Headers: job.Headers,
+		Body:    job.Body,
+	}, jobTimeoutDuration(job))
+	if err != nil {
+		result := fail(job, reg, err)
+		result.Redirects = chain.Hops()
+		return result
+	}
+
+	failed := job.Assertions.evaluate(ex.resp, ex.body, ex.truncated, ex.latencyMS)
+	finalURL := ex.resp.Request.URL.Redacted()
+	failed = append(failed, chain.checkFinalURL(finalURL)...)
+	up := job.Assertions.statusOK(ex.resp.StatusCode) && len(failed) == 0
+	result := Result{
+		Outpost: reg, Type: job.Type, Target: job.Target,
+		Up: up, LatencyMS: ex.latencyMS, StatusCode: ex.resp.StatusCode,
+		Timings:          ex.timings,
+		Redirects:        chain.Hops(),
+		FailedAssertions: failed,
+		Timestamp:        time.Now().UTC(),
+	}
+	if len(result.Redirects) > 0 {
+		result.FinalURL = finalURL
+	}
+	if len(failed) > 0 {
+		result.Error = fmt.Sprintf("%d assertion(s) failed", len(failed))
+	}
+	if job.VerifyTLS && ex.resp.TLS != nil {
+		// Verify against the name sent in SNI on the final connection,
+		// which is the server_name override on every hop when one is set
+		serverName := ex.resp.TLS.ServerName
+		if serverName == "" {
+			serverName = ex.resp.Request.URL.Hostname()
+		}
+		result.Certificate = inspectConnectionState(*ex.resp.TLS, serverName, true)
+	}
+	return result
+}
+
+// httpRequest describes a single request made by an HTTP check.
+type httpRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    string
 }
 
-func runHTTP(ctx context.Context, reg registrar.Registration, job Job) Result {
-	start := time.Now()
+// httpExchange is a completed request with its response body read.
+type httpExchange struct {
+	req       *http.Request
+	resp      *http.Response
+	body      []byte
+	truncated bool
+	latencyMS float64
+	timings   *HTTPTimings
+}
+
+// doHTTP sends the request and reads the response body, recording the
+// timing of each phase.
+func doHTTP(ctx context.Context, client *http.Client, r httpRequest, timeout time.Duration) (*httpExchange, error) {
+	timer := newHTTPTimer()
+	start := timer.start
 	method := "GET"
-	if job.Method != "" {
-		method = job.Method
+	if r.Method != "" {
+		method = r.Method
 	}
 
-	timeout := jobTimeoutDuration(job)
 	reqCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(reqCtx, method, job.Target, strings.NewReader(job.Body))
+	req, err := http.NewRequestWithContext(timer.withTrace(reqCtx), method, r.URL, strings.NewReader(r.Body))
 	if err != nil {
-		return fail(job, reg, err)
+		return nil, err
 	}
 	req.Header.Set("User-Agent", "Vigilant Bot")
-	for k, v := range job.Headers {
+	for k, v := range r.Headers {
 		req.Header.Set(k, v)
 	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	dur := time.Since(start).Seconds() * 1000
 	if err != nil {
-		return fail(job, reg, err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	up := resp.StatusCode >= 200 && resp.StatusCode < 400
-	return Result{
-		Outpost: reg, Type: job.Type, Target: job.Target,
-		Up: up, LatencyMS: dur, StatusCode: resp.StatusCode,
-		Timestamp: time.Now().UTC(),
+	// The body is always read (up to maxBodyBytes) to measure the transfer
+	body, truncated, err := readBody(resp.Body)
+	if err != nil {
+		return nil, err
 	}
+
+	return &httpExchange{
+		req:       req,
+		resp:      resp,
+		body:      body,
+		truncated: truncated,
+		latencyMS: dur,
+		timings:   timer.timings(time.Now()),
+	}, nil
 }
 
 func fail(job Job, reg registrar.Registration, err error) Result {
@@ -0,0 +1,327 @@
+package checks
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"vigilant-uptime-outpost/internal/egress"
+)
+
+// HTTPClientOptions configure the client an HTTP check is made with.
+// Clients are built once per distinct set of options and reused.
+type HTTPClientOptions struct {
+	// Proxy is an http, https, socks5 or socks5h URL, with credentials as
+	// user info
+	Proxy string `json:"proxy,omitempty"`
+	// ClientCert and ClientKey are a PEM encoded certificate and key
+	// presented to servers requiring mutual TLS
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	// CABundle is PEM encoded certificates trusted instead of the system
+	// roots when verify_tls is set
+	CABundle string `json:"ca_bundle,omitempty"`
+	// ServerName overrides the name sent in SNI and verified against the
+	// certificate
+	ServerName string `json:"server_name,omitempty"`
+	// HTTPVersion is 1.1 or 2, both are negotiated when empty
+	HTTPVersion       string    `json:"http_version,omitempty"`
+	DisableKeepAlives bool      `json:"disable_keep_alives,omitempty"`
+	Auth              *HTTPAuth `json:"auth,omitempty"`
+}
+
+type HTTPAuth struct {
+	// Type is basic (default) or digest
+	Type     string `json:"type,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// maxCachedHTTPClients bounds the clients kept for per-job options.
+const maxCachedHTTPClients = 64
+
+// client returns the HTTP client for a job. Jobs without options share the
+// two default clients.
+func (env *Env) client(verifyTLS bool, opts *HTTPClientOptions) (*http.Client, error) {
+	if opts == nil {
+		if verifyTLS {
+			return env.verifyingHTTPClient, nil
+		}
+		return env.httpClient, nil
+	}
+
+	// The key is hashed so credentials are not kept in the clear
+	raw, err := json.Marshal(struct {
+		VerifyTLS bool
+		Options   *HTTPClientOptions
+	}{verifyTLS, opts})
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	key := hex.EncodeToString(sum[:])
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if client, ok := env.clients[key]; ok {
+		return client, nil
+	}
+	client, err := newConfiguredHTTPClient(env.Egress, verifyTLS, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.clients) >= maxCachedHTTPClients {
+		// Evict an arbitrary client, its connections are closed once idle
+		for k, old := range env.clients {
+			old.CloseIdleConnections()
+			delete(env.clients, k)
+			break
+		}
+	}
+	env.clients[key] = client
+	return client, nil
+}
+
+// newConfiguredHTTPClient returns a client connecting through the egress
+// policy with the given options applied.
+func newConfiguredHTTPClient(policy *egress.Policy, verifyTLS bool, opts *HTTPClientOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !verifyTLS,
+		ServerName:         opts.ServerName,
+	}
+	if opts.CABundle != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(opts.CABundle)) {
+			return nil, fmt.Errorf("ca_bundle contains no PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(opts.ClientCert), []byte(opts.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client := newHTTPClient(policy, tlsConfig)
+	transport := client.Transport.(*http.Transport)
+	transport.ForceAttemptHTTP2 = verifyTLS
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+
+	switch opts.HTTPVersion {
+	case "":
+	case "1.1":
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case "2":
+		// Plain http targets are spoken to with HTTP/2 with prior knowledge
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unsupported http_version: %q", opts.HTTPVersion)
+	}
+
+	if opts.Proxy != "" {
+		if err := policy.CheckProxy(); err != nil {
+			return nil, err
+		}
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+		}
+		// The proxy address is checked when dialing it. Targets are reached
+		// from the proxy's network and may only be resolvable there, so
+		// only their names and IP literals are checked, which is why
+		// proxies must be trusted explicitly.
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := policy.CheckHost(req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+	}
+
+	if opts.Auth != nil {
+		switch strings.ToLower(opts.Auth.Type) {
+		case "", "basic":
+			client.Transport = &basicAuthTransport{base: transport, auth: *opts.Auth}
+		case "digest":
+			client.Transport = &digestAuthTransport{base: transport, auth: *opts.Auth}
+		default:
+			return nil, fmt.Errorf("unsupported auth type: %q", opts.Auth.Type)
+		}
+	}
+	return client, nil
+}
+
+type basicAuthTransport struct {
+	base http.RoundTripper
+	auth HTTPAuth
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !sameHostAsOrigin(req) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.auth.Username, t.auth.Password)
+	return t.base.RoundTrip(req)
+}
+
+// digestAuthTransport answers digest challenges (RFC 7616) by repeating
+// the request with credentials.
+type digestAuthTransport struct {
+	base http.RoundTripper
+	auth HTTPAuth
+}
+
+func (t *digestAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !sameHostAsOrigin(req) {
+		return resp, err
+	}
+	challenge, ok := parseDigestChallenge(resp.Header.Values("WWW-Authenticate"))
+	if !ok {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return resp, nil
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	authorization, err := challenge.authorize(t.auth, req.Method, req.URL.RequestURI())
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("digest auth: %w", err)
+	}
+	retry.Header.Set("Authorization", authorization)
+	return t.base.RoundTrip(retry)
+}
+
+// sameHostAsOrigin reports whether req goes to the host of the request
+// that started its redirect chain. Credentials are only sent there.
+func sameHostAsOrigin(req *http.Request) bool {
+	origin := req
+	for origin.Response != nil && origin.Response.Request != nil {
+		origin = origin.Response.Request
+	}
+	return origin.URL.Host == req.URL.Host
+}
+
+type digestChallenge map[string]string
+
+// parseDigestChallenge returns the parameters of the first digest
+// challenge among the WWW-Authenticate headers.
+func parseDigestChallenge(headers []string) (digestChallenge, bool) {
+	for _, header := range headers {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(header), " ")
+		if !strings.EqualFold(scheme, "Digest") {
+			continue
+		}
+		challenge := digestChallenge{}
+		for params != "" {
+			var key, value string
+			key, params, _ = strings.Cut(strings.TrimLeft(params, " ,"), "=")
+			params = strings.TrimLeft(params, " ")
+			if strings.HasPrefix(params, `"`) {
+				end := strings.Index(params[1:], `"`)
+				if end < 0 {
+					return nil, false
+				}
+				value, params = params[1:end+1], params[end+2:]
+			} else {
+				value, params, _ = strings.Cut(params, ",")
+			}
+			challenge[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+		}
+		return challenge, challenge["nonce"] != ""
+	}
+	return nil, false
+}
+
+// authorize returns the Authorization header answering the challenge.
+func (c digestChallenge) authorize(auth HTTPAuth, method, uri string) (string, error) {
+	algorithm := c["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	const nc = "00000001"
+
+	realm, nonce := c["realm"], c["nonce"]
+	ha1 := h(auth.Username + ":" + realm + ":" + auth.Password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	// Only qop=auth is supported, a challenge offering just auth-int is
+	// refused rather than answered without qop
+	qop := ""
+	if offered, ok := c["qop"]; ok {
+		for _, q := range strings.Split(offered, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported qop %q", offered)
+		}
+	}
+	var response string
+	if qop != "" {
+		response = h(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	header := fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, response=%q`,
+		auth.Username, realm, nonce, uri, algorithm, response)
+	if qop != "" {
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce=%q`, qop, nc, cnonce)
+	}
+	if opaque, ok := c["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque=%q`, opaque)
+	}
+	return header, nil
+}
@@ -0,0 +1,318 @@
+package checks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("http_flow", "Runs an ordered list of HTTP requests sharing cookies and extracted values", httpFlowOptionsSchema, CheckRunnerFunc(runHTTPFlow))
+}
+
+const httpFlowOptionsSchema = `{
+	"type": "object",
+	"required": ["target", "http_flow"],
+	"properties": {
+		"target": {"type": "string", "format": "uri", "description": "base URL that relative step URLs are resolved against"},
+		"verify_tls": {"type": "boolean", "default": false},
+		"http_client": {"type": "object", "description": "same as the http_client of the http check"},
+		"http_flow": {
+			"type": "object",
+			"required": ["steps"],
+			"properties": {
+				"steps": {
+					"type": "array",
+					"minItems": 1,
+					"items": {
+						"type": "object",
+						"required": ["url"],
+						"properties": {
+							"name": {"type": "string"},
+							"url": {"type": "string", "description": "absolute or relative to target, may contain {{variables}}, which are URL escaped unless the URL starts with them"},
+							"method": {"type": "string", "default": "GET"},
+							"headers": {"type": "object", "additionalProperties": {"type": "string"}},
+							"body": {"type": "string"},
+							"assertions": {"type": "object", "description": "same as the assertions of the http check"},
+							"extract": {
+								"type": "array",
+								"items": {
+									"type": "object",
+									"required": ["name"],
+									"properties": {
+										"name": {"type": "string"},
+										"json_path": {"type": "string"},
+										"regex": {"type": "string", "description": "the first capture group, or the whole match without one"},
+										"header": {"type": "string"}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}`
+
+type HTTPFlowOptions struct {
+	// Steps run in order, the flow stops at the first failing step
+	Steps []HTTPFlowStep `json:"steps"`
+}
+
+type HTTPFlowStep struct {
+	Name string `json:"name,omitempty"`
+	// URL is absolute or relative to the job target. URL, headers and body
+	// may reference values extracted by earlier steps as {{name}}.
+	URL        string            `json:"url"`
+	Method     string            `json:"method,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	Assertions *HTTPAssertions   `json:"assertions,omitempty"`
+	Extract    []HTTPExtraction  `json:"extract,omitempty"`
+}
+
+// HTTPExtraction captures a value from a response into a variable. Exactly
+// one of JSONPath, Regex and Header is set.
+type HTTPExtraction struct {
+	Name     string `json:"name"`
+	JSONPath string `json:"json_path,omitempty"`
+	// Regex captures its first group, or the whole match without groups
+	Regex  string `json:"regex,omitempty"`
+	Header string `json:"header,omitempty"`
+}
+
+type HTTPFlowStepResult struct {
+	Name             string       `json:"name,omitempty"`
+	Method           string       `json:"method"`
+	URL              string       `json:"url"`
+	Up               bool         `json:"up"`
+	StatusCode       int          `json:"status_code,omitempty"`
+	LatencyMS        float64      `json:"latency_ms"`
+	Timings          *HTTPTimings `json:"timings,omitempty"`
+	FailedAssertions []string     `json:"failed_assertions,omitempty"`
+	Error            string       `json:"error,omitempty"`
+}
+
+var templateVar = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+func runHTTPFlow(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+	if job.HTTPFlow == nil || len(job.HTTPFlow.Steps) == 0 {
+		return fail(job, reg, fmt.Errorf("http_flow requires at least one step"))
+	}
+	base, err := url.Parse(job.Target)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	// Cookies are shared between the steps of a single run only
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	shared, err := env.client(job.VerifyTLS, job.HTTPClient)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	client := &http.Client{
+		Transport:     shared.Transport,
+		CheckRedirect: shared.CheckRedirect,
+		Jar:           jar,
+	}
+
+	// The job timeout bounds the whole flow, each step gets what is left
+	ctx, cancel := context.WithTimeout(ctx, jobTimeoutDuration(job))
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	vars := map[string]string{}
+	result := Result{
+		Outpost: reg, Type: job.Type, Target: job.Target,
+		Steps: make([]HTTPFlowStepResult, 0, len(job.HTTPFlow.Steps)),
+	}
+	for i, step := range job.HTTPFlow.Steps {
+		stepResult := runHTTPFlowStep(ctx, client, base, step, vars, time.Until(deadline))
+		result.Steps = append(result.Steps, stepResult)
+		result.LatencyMS += stepResult.LatencyMS
+		result.StatusCode = stepResult.StatusCode
+		if !stepResult.Up {
+			result.Error = fmt.Sprintf("step %d", i+1)
+			if step.Name != "" {
+				result.Error += fmt.Sprintf(" (%s)", step.Name)
+			}
+			result.Error += ": " + stepResult.Error
+			result.Timestamp = time.Now().UTC()
+			return result
+		}
+	}
+
+	result.Up = true
+	result.Timestamp = time.Now().UTC()
+	return result
+}
+
+func runHTTPFlowStep(ctx context.Context, client *http.Client, base *url.URL, step HTTPFlowStep, vars map[string]string, timeout time.Duration) HTTPFlowStepResult {
+	method := step.Method
+	if method == "" {
+		method = "GET"
+	}
+	res := HTTPFlowStepResult{Name: step.Name, Method: method, URL: step.URL}
+
+	req, err := expandHTTPFlowStep(base, step, vars)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	req.Method = method
+	res.URL = req.URL
+
+	ex, err := doHTTP(ctx, client, req, timeout)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.StatusCode = ex.resp.StatusCode
+	res.LatencyMS = ex.latencyMS
+	res.Timings = ex.timings
+
+	res.FailedAssertions = step.Assertions.evaluate(ex.resp, ex.body, ex.truncated, ex.latencyMS)
+	if len(res.FailedAssertions) > 0 {
+		res.Error = fmt.Sprintf("%d assertion(s) failed", len(res.FailedAssertions))
+		return res
+	}
+	if !step.Assertions.statusOK(ex.resp.StatusCode) {
+		res.Error = fmt.Sprintf("unexpected status code %d", ex.resp.StatusCode)
+		return res
+	}
+
+	for _, extraction := range step.Extract {
+		value, err := extraction.extract(ex.resp, ex.body)
+		if err != nil {
+			res.Error = fmt.Sprintf("extract %s: %v", extraction.Name, err)
+			return res
+		}
+		vars[extraction.Name] = value
+	}
+	res.Up = true
+	return res
+}
+
+// expandHTTPFlowStep substitutes variables into the step and resolves its
+// URL against the job target. Values are escaped for the part of the URL
+// they are substituted into, so they cannot add path segments or query
+// parameters. A variable the URL starts with is inserted as is, so that it
+// can hold a whole URL, such as an extracted Location header, or its scheme
+// and host.
+func expandHTTPFlowStep(base *url.URL, step HTTPFlowStep, vars map[string]string) (httpRequest, error) {
+	path, query, hasQuery := strings.Cut(step.URL, "?")
+	prefixLen := 0
+	if loc := templateVar.FindStringIndex(path); loc != nil && loc[0] == 0 {
+		prefixLen = loc[1]
+	}
+	prefix, err := expandTemplate(path[:prefixLen], vars, nil)
+	if err != nil {
+		return httpRequest{}, err
+	}
+	rest, err := expandTemplate(path[prefixLen:], vars, url.PathEscape)
+	if err != nil {
+		return httpRequest{}, err
+	}
+	rawURL := prefix + rest
+	if hasQuery {
+		query, err = expandTemplate(query, vars, url.QueryEscape)
+		if err != nil {
+			return httpRequest{}, err
+		}
+		rawURL += "?" + query
+	}
+	ref, err := url.Parse(rawURL)
+	if err != nil {
+		return httpRequest{}, err
+	}
+	body, err := expandTemplate(step.Body, vars, nil)
+	if err != nil {
+		return httpRequest{}, err
+	}
+	headers := make(map[string]string, len(step.Headers))
+	for k, v := range step.Headers {
+		if headers[k], err = expandTemplate(v, vars, nil); err != nil {
+			return httpRequest{}, err
+		}
+	}
+	return httpRequest{
+		URL:     base.ResolveReference(ref).String(),
+		Headers: headers,
+		Body:    body,
+	}, nil
+}
+
+// expandTemplate replaces every {{name}} with its variable, passed through
+// escape when it is not nil. Referencing a variable that no earlier step
+// extracted is an error.
+func expandTemplate(s string, vars map[string]string, escape func(string) string) (string, error) {
+	var missing string
+	out := templateVar.ReplaceAllStringFunc(s, func(m string) string {
+		name := templateVar.FindStringSubmatch(m)[1]
+		value, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		if escape != nil {
+			return escape(value)
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %q", missing)
+	}
+	return out, nil
+}
+
+func (e HTTPExtraction) extract(resp *http.Response, body []byte) (string, error) {
+	switch {
+	case e.Header != "":
+		value := resp.Header.Get(e.Header)
+		if value == "" {
+			return "", fmt.Errorf("header %q missing", e.Header)
+		}
+		return value, nil
+	case e.Regex != "":
+		re, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return "", fmt.Errorf("invalid regex %q: %v", e.Regex, err)
+		}
+		m := re.FindSubmatch(body)
+		if m == nil {
+			return "", fmt.Errorf("body does not match %q", e.Regex)
+		}
+		if len(m) > 1 {
+			return string(m[1]), nil
+		}
+		return string(m[0]), nil
+	case e.JSONPath != "":
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "", fmt.Errorf("body is not valid JSON: %v", err)
+		}
+		values, err := evalJSONPath(doc, e.JSONPath)
+		if err != nil {
+			return "", err
+		}
+		if len(values) == 0 {
+			return "", fmt.Errorf("%s does not exist", e.JSONPath)
+		}
+		if s, ok := values[0].(string); ok {
+			return s, nil
+		}
+		return formatJSONValue(values[0]), nil
+	default:
+		return "", fmt.Errorf("one of json_path, regex or header is required")
+	}
+}
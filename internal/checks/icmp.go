@@ -3,63 +3,317 @@ package checks
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
-	"os/exec"
-	"regexp"
-	"strconv"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"vigilant-uptime-outpost/internal/registrar"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"vigilant-uptime-outpost/internal/egress"
+)
+
+func init() {
+	Register("icmp", "Sends ICMP echo requests and reports round-trip times and packet loss", icmpOptionsSchema, CheckRunnerFunc(runICMP))
+}
+
+const icmpOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "hostname or IP address"},
+		"icmp": {
+			"type": "object",
+			"properties": {
+				"count": {"type": "integer", "minimum": 1, "maximum": 100, "default": 1},
+				"interval_ms": {"type": "integer", "minimum": 10, "default": 1000},
+				"size": {"type": "integer", "minimum": 0, "maximum": 65000, "default": 56}
+			}
+		}
+	}
+}`
+
+const (
+	protocolICMP     = 1
+	protocolICMPv6   = 58
+	defaultICMPCount = 1
+	maxICMPCount     = 100
+	defaultICMPSize  = 56
+	maxICMPSize      = 65000
+
+	defaultICMPIntervalMS = 1000
+	minICMPIntervalMS     = 10
+
+	// maxICMPReplyWait is the most a request sent under an explicit
+	// timeout needs left for its reply
+	maxICMPReplyWait = time.Second
 )
 
-var pingRTTRegex = regexp.MustCompile(`time[=:]\s*(\d+(?:\.\d+)?)\s*ms`)
+type ICMPOptions struct {
+	Count      int `json:"count,omitempty"`
+	IntervalMS int `json:"interval_ms,omitempty"`
+	Size       int `json:"size,omitempty"`
+}
 
-func runICMP(ctx context.Context, reg registrar.Registration, job Job) Result {
+type ICMPStats struct {
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	MinMS       float64 `json:"min_ms"`
+	AvgMS       float64 `json:"avg_ms"`
+	MaxMS       float64 `json:"max_ms"`
+	StdDevMS    float64 `json:"stddev_ms"`
+}
+
+func runICMP(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
 	target, err := sanitizePingTarget(job.Target)
 	if err != nil {
 		return fail(job, reg, err)
 	}
 
+	count, interval, size := icmpOptions(job.ICMP)
+	spread := time.Duration(count-1) * interval
+
+	// Without a timeout every request gets the default timeout for its
+	// reply. An explicit timeout bounds the whole run and must leave the
+	// last request time for its reply.
 	timeout := jobTimeoutDuration(job)
-	timeoutSeconds := int(timeout.Seconds())
-	if timeoutSeconds < 1 {
-		timeoutSeconds = 1
+	replyWait := timeout
+	if job.Timeout > 0 {
+		replyWait = min(maxICMPReplyWait, timeout/2)
+		if spread+replyWait > timeout {
+			return fail(job, reg, fmt.Errorf("%d echo requests %s apart do not fit in the %s timeout", count, interval, timeout))
+		}
+	} else {
+		timeout = spread + replyWait
 	}
 
-	cmd := exec.CommandContext(ctx, "ping", "-c", "1", "-w", strconv.Itoa(timeoutSeconds), target)
-	output, err := cmd.CombinedOutput()
-
+	ip, err := resolveTargetIP(ctx, env.Egress, target)
 	if err != nil {
-		trimmed := strings.TrimSpace(string(output))
-		if trimmed != "" {
-			err = fmt.Errorf("ping failed: %w: %s", err, trimmed)
-		}
 		return fail(job, reg, err)
 	}
 
-	// Parse the actual RTT from ping output
-	latency, err := parseRTT(string(output))
+	stats, err := ping(ctx, ip, count, interval, size, replyWait, timeout)
 	if err != nil {
-		return fail(job, reg, fmt.Errorf("failed to parse ping RTT: %w", err))
+		return fail(job, reg, err)
 	}
 
-	return Result{
+	result := Result{
 		Outpost:   reg,
 		Type:      job.Type,
 		Target:    target,
-		Up:        true,
-		LatencyMS: latency,
+		Up:        stats.Received > 0,
+		LatencyMS: stats.AvgMS,
+		ICMP:      stats,
 		Timestamp: time.Now().UTC(),
 	}
+	// A host that does not reply is down, which is not an error
+	return result
 }
 
-func parseRTT(output string) (float64, error) {
-	matches := pingRTTRegex.FindStringSubmatch(output)
-	if len(matches) < 2 {
-		return 0, fmt.Errorf("RTT not found in ping output")
+func icmpOptions(opts *ICMPOptions) (int, time.Duration, int) {
+	count, intervalMS, size := defaultICMPCount, defaultICMPIntervalMS, defaultICMPSize
+	if opts != nil {
+		if opts.Count > 0 {
+			count = min(opts.Count, maxICMPCount)
+		}
+		if opts.IntervalMS > 0 {
+			intervalMS = max(opts.IntervalMS, minICMPIntervalMS)
+		}
+		if opts.Size > 0 {
+			size = min(opts.Size, maxICMPSize)
+		}
+	}
+	return count, time.Duration(intervalMS) * time.Millisecond, size
+}
+
+// ping sends count echo requests to ip and collects the replies for at most
+// timeout. A request is only sent while at least replyWait is left for its
+// reply, requests that are not sent are not reported in Sent.
+func ping(ctx context.Context, ip net.IP, count int, interval time.Duration, size int, replyWait, timeout time.Duration) (*ICMPStats, error) {
+	isV6 := ip.To4() == nil
+	conn, privileged, err := listenICMP(isV6)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if privileged {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	// Unprivileged sockets get their ID assigned by the kernel, which also
+	// filters replies for us. Raw sockets see every reply and match on the ID.
+	id := rand.Intn(0xffff)
+	proto := protocolICMP
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if isV6 {
+		proto = protocolICMPv6
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	var (
+		mu      sync.Mutex
+		sentAt  = make(map[int]time.Time, count)
+		rtts    = make([]float64, 0, count)
+		allDone = make(chan struct{})
+	)
+
+	go func() {
+		buf := make([]byte, size+512)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received := time.Now()
+			msg, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || msg.Type != replyType {
+				continue
+			}
+			echo, ok := msg.Body.(*icmp.Echo)
+			if !ok || (privileged && echo.ID != id) {
+				continue
+			}
+
+			mu.Lock()
+			sent, ok := sentAt[echo.Seq]
+			if ok {
+				delete(sentAt, echo.Seq)
+				rtts = append(rtts, received.Sub(sent).Seconds()*1000)
+				if len(rtts) == count {
+					close(allDone)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(ctx, start.Add(timeout))
+	defer cancel()
+	sent := 0
+send:
+	for seq := 0; seq < count; seq++ {
+		// Requests are scheduled from the start, so that the decision does
+		// not depend on how late the timer fires
+		if time.Duration(seq)*interval+replyWait > timeout {
+			break
+		}
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				break send
+			case <-time.After(time.Until(start.Add(time.Duration(seq) * interval))):
+			}
+		}
+
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		sentAt[seq] = time.Now()
+		mu.Unlock()
+		if _, err := conn.WriteTo(b, dst); err != nil {
+			return nil, fmt.Errorf("failed to send echo request: %w", err)
+		}
+		sent++
+	}
+
+	// Wait for the outstanding replies until the run ends
+	select {
+	case <-allDone:
+	case <-ctx.Done():
+	}
+	conn.SetReadDeadline(time.Now())
+
+	mu.Lock()
+	defer mu.Unlock()
+	return icmpStats(sent, rtts), nil
+}
+
+func icmpStats(sent int, rtts []float64) *ICMPStats {
+	stats := &ICMPStats{
+		Sent:        sent,
+		Received:    len(rtts),
+		LossPercent: float64(sent-len(rtts)) / float64(sent) * 100,
+	}
+	if len(rtts) == 0 {
+		return stats
+	}
+
+	stats.MinMS = math.Inf(1)
+	var sum float64
+	for _, rtt := range rtts {
+		sum += rtt
+		stats.MinMS = math.Min(stats.MinMS, rtt)
+		stats.MaxMS = math.Max(stats.MaxMS, rtt)
+	}
+	stats.AvgMS = sum / float64(len(rtts))
+
+	var variance float64
+	for _, rtt := range rtts {
+		variance += (rtt - stats.AvgMS) * (rtt - stats.AvgMS)
+	}
+	stats.StdDevMS = math.Sqrt(variance / float64(len(rtts)))
+	return stats
+}
+
+// listenICMP opens an ICMP endpoint, preferring unprivileged datagram
+// sockets and falling back to raw sockets. It reports whether the returned
+// endpoint is a raw socket.
+func listenICMP(isV6 bool) (*icmp.PacketConn, bool, error) {
+	network, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if isV6 {
+		network, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	conn, err := icmp.ListenPacket(network, address)
+	if err == nil {
+		return conn, false, nil
+	}
+
+	conn, rawErr := icmp.ListenPacket(rawNetwork, address)
+	if rawErr == nil {
+		return conn, true, nil
+	}
+	if os.IsPermission(rawErr) {
+		return nil, false, fmt.Errorf("ICMP not permitted: unprivileged sockets unavailable (%v) and raw sockets require CAP_NET_RAW", err)
+	}
+	return nil, false, fmt.Errorf("failed to open ICMP socket: %w", rawErr)
+}
+
+// resolveTargetIP resolves a hostname to a single address allowed by the
+// egress policy, preferring IPv4.
+func resolveTargetIP(ctx context.Context, policy *egress.Policy, target string) (net.IP, error) {
+	ips, err := policy.Resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
 	}
-	return strconv.ParseFloat(matches[1], 64)
+	return ips[0], nil
 }
 
 func sanitizePingTarget(raw string) (string, error) {
@@ -0,0 +1,104 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"vigilant-uptime-outpost/internal/metrics"
+)
+
+// ErrQueueFull is returned by Admit when the queue cannot hold the checks.
+var ErrQueueFull = errors.New("check queue is full")
+
+var checksQueued = metrics.NewGauge("outpost_checks_queued", "Admitted checks waiting for a free slot.")
+
+// Limits bounds how many checks run at the same time and how many may wait
+// for a free slot.
+type Limits struct {
+	// MaxConcurrency is the number of checks running at the same time
+	MaxConcurrency int
+	// QueueSize is the number of admitted checks that may wait for a slot
+	QueueSize int
+	// PerType limits the concurrency of individual check types, such as
+	// traceroutes which hold a socket for a long time
+	PerType map[string]int
+}
+
+// limiter implements Limits. Checks are admitted up front, so that a batch
+// is either queued as a whole or rejected, and then wait for a slot of
+// their type before taking a global slot.
+type limiter struct {
+	mu        sync.Mutex
+	admitted  int
+	capacity  int
+	slots     chan struct{}
+	typeSlots map[string]chan struct{}
+}
+
+func newLimiter(limits Limits) *limiter {
+	l := &limiter{
+		capacity:  limits.MaxConcurrency + limits.QueueSize,
+		slots:     make(chan struct{}, limits.MaxConcurrency),
+		typeSlots: make(map[string]chan struct{}),
+	}
+	for checkType, n := range limits.PerType {
+		if n > 0 {
+			l.typeSlots[checkType] = make(chan struct{}, n)
+		}
+	}
+	return l
+}
+
+// admit reserves room for n checks, or returns ErrQueueFull without
+// reserving anything.
+func (l *limiter) admit(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.admitted+n > l.capacity {
+		return ErrQueueFull
+	}
+	l.admitted += n
+	return nil
+}
+
+// done releases the reservation of a finished check.
+func (l *limiter) done() {
+	l.mu.Lock()
+	l.admitted--
+	l.mu.Unlock()
+}
+
+// acquire waits for a slot to run a check of the given type. It returns the
+// time spent waiting and a function releasing the slot.
+func (l *limiter) acquire(ctx context.Context, checkType string) (time.Duration, func(), error) {
+	start := time.Now()
+	checksQueued.Inc()
+	defer checksQueued.Dec()
+
+	typeSlots := l.typeSlots[checkType]
+	if typeSlots != nil {
+		select {
+		case typeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return time.Since(start), nil, ctx.Err()
+		}
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		if typeSlots != nil {
+			<-typeSlots
+		}
+		return time.Since(start), nil, ctx.Err()
+	}
+
+	return time.Since(start), func() {
+		<-l.slots
+		if typeSlots != nil {
+			<-typeSlots
+		}
+	}, nil
+}
@@ -0,0 +1,135 @@
+package checks
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+type RedirectOptions struct {
+	// Follow disables following redirects when false, the redirect
+	// response itself is then checked
+	Follow *bool `json:"follow,omitempty"`
+	// MaxRedirects caps the number of redirects followed (default 10)
+	MaxRedirects int `json:"max_redirects,omitempty"`
+	// FinalURL is the URL the last response must come from
+	FinalURL string `json:"final_url,omitempty"`
+	// FinalURLRegex is a regular expression the final URL must match
+	FinalURLRegex string `json:"final_url_regex,omitempty"`
+}
+
+type RedirectHop struct {
+	URL        string  `json:"url"`
+	StatusCode int     `json:"status_code"`
+	Location   string  `json:"location"`
+	LatencyMS  float64 `json:"latency_ms"`
+	// ServerName is the name sent in SNI for https hops, which is the
+	// server_name client option when one is set
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// redirectChain records the redirects followed by a single request.
+type redirectChain struct {
+	opts *RedirectOptions
+
+	mu   sync.Mutex
+	last time.Time
+	hops []RedirectHop
+}
+
+func newRedirectChain(opts *RedirectOptions) *redirectChain {
+	return &redirectChain{opts: opts, last: time.Now()}
+}
+
+// client returns a client sharing the transport of base that records each
+// redirect and enforces the job's redirect options on top of the checks
+// of base.
+func (c *redirectChain) client(base *http.Client) *http.Client {
+	limit := maxRedirects
+	follow := true
+	if c.opts != nil {
+		if c.opts.MaxRedirects > 0 {
+			limit = c.opts.MaxRedirects
+		}
+		if c.opts.Follow != nil {
+			follow = *c.opts.Follow
+		}
+	}
+
+	return &http.Client{
+		Transport: base.Transport,
+		Jar:       base.Jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			c.record(req, via)
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			for _, prev := range via {
+				if prev.URL.String() == req.URL.String() {
+					return fmt.Errorf("redirect loop at %s", req.URL.Redacted())
+				}
+			}
+			if len(via) > limit {
+				return fmt.Errorf("stopped after %d redirects", limit)
+			}
+			if base.CheckRedirect != nil {
+				// Let the base client apply the egress policy without its
+				// own cap, which the job may have raised
+				return base.CheckRedirect(req, via[len(via)-1:])
+			}
+			return nil
+		},
+	}
+}
+
+// record adds the response that caused the redirect to req to the chain.
+func (c *redirectChain) record(req *http.Request, via []*http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	hop := RedirectHop{
+		URL:       via[len(via)-1].URL.Redacted(),
+		Location:  req.URL.Redacted(),
+		LatencyMS: durationMS(now.Sub(c.last)),
+	}
+	if req.Response != nil {
+		hop.StatusCode = req.Response.StatusCode
+		if req.Response.TLS != nil {
+			hop.ServerName = req.Response.TLS.ServerName
+		}
+	}
+	c.hops = append(c.hops, hop)
+	c.last = now
+}
+
+// Hops returns the redirects recorded so far.
+func (c *redirectChain) Hops() []RedirectHop {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hops
+}
+
+// checkFinalURL returns a failure when the URL the response came from does
+// not match the job's expectation.
+func (c *redirectChain) checkFinalURL(finalURL string) []string {
+	if c.opts == nil {
+		return nil
+	}
+	var failed []string
+	if c.opts.FinalURL != "" && finalURL != c.opts.FinalURL {
+		failed = append(failed, fmt.Sprintf("final URL is %q, expected %q", finalURL, c.opts.FinalURL))
+	}
+	if c.opts.FinalURLRegex != "" {
+		re, err := regexp.Compile(c.opts.FinalURLRegex)
+		switch {
+		case err != nil:
+			failed = append(failed, fmt.Sprintf("invalid regex %q: %v", c.opts.FinalURLRegex, err))
+		case !re.MatchString(finalURL):
+			failed = append(failed, fmt.Sprintf("final URL %q does not match %q", finalURL, c.opts.FinalURLRegex))
+		}
+	}
+	return failed
+}
@@ -0,0 +1,108 @@
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"vigilant-uptime-outpost/internal/egress"
+	"vigilant-uptime-outpost/internal/registrar"
+)
+
+// Env holds what a check runner needs from the outpost besides the job.
+type Env struct {
+	Outpost registrar.Registration
+	// Egress decides which addresses checks may connect to. A nil policy
+	// allows everything.
+	Egress *egress.Policy
+
+	httpClient          *http.Client
+	verifyingHTTPClient *http.Client
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+func newEnv(outpost registrar.Registration, policy *egress.Policy) *Env {
+	env := &Env{Outpost: outpost, Egress: policy, clients: map[string]*http.Client{}}
+	env.httpClient = newHTTPClient(policy, &tls.Config{InsecureSkipVerify: true})
+	env.verifyingHTTPClient = newHTTPClient(policy, nil)
+	return env
+}
+
+// CheckRunner executes a single check of the type it was registered for.
+type CheckRunner interface {
+	Run(ctx context.Context, env *Env, job Job) Result
+}
+
+// CheckRunnerFunc adapts a function to the CheckRunner interface.
+type CheckRunnerFunc func(ctx context.Context, env *Env, job Job) Result
+
+func (f CheckRunnerFunc) Run(ctx context.Context, env *Env, job Job) Result {
+	return f(ctx, env, job)
+}
+
+// CheckType describes a registered check type. Options holds the JSON
+// schema of the job fields the type understands.
+type CheckType struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description"`
+	Options     json.RawMessage `json:"options"`
+	runner      CheckRunner
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*CheckType)
+)
+
+// Register makes a check type available to Checker.Run. The schema must be
+// a valid JSON document. Register panics when called twice for the same
+// type or with an invalid schema.
+func Register(name, description, schema string, runner CheckRunner) {
+	if runner == nil {
+		panic("checks: Register runner is nil for " + name)
+	}
+	if !json.Valid([]byte(schema)) {
+		panic("checks: Register schema is not valid JSON for " + name)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("checks: Register called twice for %q", name))
+	}
+	registry[name] = &CheckType{
+		Type:        name,
+		Description: description,
+		Options:     json.RawMessage(schema),
+		runner:      runner,
+	}
+}
+
+// Types returns the registered check types sorted by name.
+func Types() []CheckType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]CheckType, 0, len(registry))
+	for _, t := range registry {
+		types = append(types, *t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Type < types[j].Type })
+	return types
+}
+
+func lookupRunner(name string) (CheckRunner, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	t, ok := registry[name]
+	if !ok {
+		return nil, false
+	}
+	return t.runner, true
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package checks
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setTTLControl(int) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errors.New("TCP traceroute is not supported on this platform")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package checks
+
+import (
+	"syscall"
+)
+
+// setTTLControl returns a dialer control function that sets the IP TTL (or
+// IPv6 hop limit) on the socket before it connects.
+func setTTLControl(ttl int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+				return
+			}
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -2,35 +2,174 @@ package checks
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"time"
-
-	"vigilant-uptime-outpost/internal/registrar"
 )
 
-func runTCP(ctx context.Context, reg registrar.Registration, job Job) Result {
+func init() {
+	Register("tcp", "Connects to a TCP port and optionally exchanges data", tcpOptionsSchema, CheckRunnerFunc(runTCP))
+}
+
+const tcpOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "host:port to connect to"},
+		"tcp": {
+			"type": "object",
+			"properties": {
+				"send": {"type": "string"},
+				"send_hex": {"type": "string"},
+				"expect": {"type": "string"},
+				"expect_regex": {"type": "string"},
+				"expect_hex": {"type": "string"},
+				"read_timeout_ms": {"type": "integer"},
+				"tls": {"type": "boolean", "default": false},
+				"server_name": {"type": "string"},
+				"verify_tls": {"type": "boolean", "default": false}
+			}
+		}
+	}
+}`
+
+type TCPOptions struct {
+	ExchangeOptions
+	// TLS wraps the connection in TLS before exchanging data
+	TLS        bool   `json:"tls,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+	VerifyTLS  bool   `json:"verify_tls,omitempty"`
+}
+
+func runTCP(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
 	start := time.Now()
-	
+
 	timeout := jobTimeoutDuration(job)
+	deadline := start.Add(timeout)
+
+	var exchange *ExchangeOptions
+	if job.TCP != nil {
+		exchange = &job.TCP.ExchangeOptions
+	}
+	payload, err := exchange.payload()
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	matcher, err := exchange.matcher()
+	if err != nil {
+		return fail(job, reg, err)
+	}
 
 	dialer := &net.Dialer{
 		Timeout: timeout,
 	}
-	
-	conn, err := dialer.DialContext(ctx, "tcp", job.Target)
+
+	conn, err := env.Egress.DialContext(dialer)(ctx, "tcp", job.Target)
 	dur := time.Since(start).Seconds() * 1000
-	
+
 	if err != nil {
 		return fail(job, reg, err)
 	}
 	defer conn.Close()
-	
-	return Result{
+
+	result := Result{
 		Outpost:   reg,
 		Type:      job.Type,
 		Target:    job.Target,
-		Up:        true,
 		LatencyMS: dur,
 		Timestamp: time.Now().UTC(),
 	}
+
+	if job.TCP != nil && job.TCP.TLS {
+		tlsConn, err := tlsClientHandshake(ctx, conn, job.Target, job.TCP, deadline)
+		if err != nil {
+			return fail(job, reg, err)
+		}
+		conn = tlsConn
+		// Without verify_tls the chain is not verified here either, so an
+		// untrusted certificate does not read as a failure of an up check
+		result.Certificate = inspectConnectionState(tlsConn.ConnectionState(), tlsConn.ConnectionState().ServerName, job.TCP.VerifyTLS)
+	}
+
+	if len(payload) == 0 && matcher.empty() {
+		result.Up = true
+		result.Timestamp = time.Now().UTC()
+		return result
+	}
+
+	conn.SetDeadline(deadline)
+	if len(payload) > 0 {
+		if _, err := conn.Write(payload); err != nil {
+			return fail(job, reg, err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(exchange.readTimeout(time.Until(deadline))))
+	var resp []byte
+	var matchErr error
+	if matcher.empty() {
+		// Nothing to verify, only capture a response when asked to wait for one
+		if exchange.ReadTimeoutMS > 0 {
+			buf := make([]byte, maxReportedBytes)
+			n, _ := conn.Read(buf)
+			resp = buf[:n]
+		}
+	} else {
+		resp, matchErr = readUntilMatch(conn, matcher)
+	}
+
+	result.LatencyMS = time.Since(start).Seconds() * 1000
+	result.Response = formatResponse(resp)
+	result.Timestamp = time.Now().UTC()
+	if matchErr != nil {
+		result.Error = matchErr.Error()
+		return result
+	}
+	result.Up = true
+	return result
+}
+
+// tlsClientHandshake wraps conn in a TLS client and completes the handshake.
+func tlsClientHandshake(ctx context.Context, conn net.Conn, target string, opts *TCPOptions, deadline time.Time) (*tls.Conn, error) {
+	serverName := opts.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: !opts.VerifyTLS,
+	})
+	hsCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// readUntilMatch reads from conn until the response satisfies the matcher,
+// the peer closes the connection or the read deadline passes.
+func readUntilMatch(conn net.Conn, matcher *responseMatcher) ([]byte, error) {
+	var resp []byte
+	buf := make([]byte, 4096)
+	for len(resp) < maxResponseBytes {
+		n, err := conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if n > 0 && matcher.match(resp) == nil {
+			return resp, nil
+		}
+		if err != nil {
+			if len(resp) == 0 {
+				return resp, err
+			}
+			return resp, matcher.match(resp)
+		}
+	}
+	return resp, matcher.match(resp)
 }
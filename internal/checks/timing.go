@@ -0,0 +1,115 @@
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+type HTTPTimings struct {
+	DNSLookupMS    float64 `json:"dns_lookup_ms"`
+	TCPConnectMS   float64 `json:"tcp_connect_ms"`
+	TLSHandshakeMS float64 `json:"tls_handshake_ms"`
+	TTFBMS         float64 `json:"ttfb_ms"`
+	TransferMS     float64 `json:"transfer_ms"`
+	TotalMS        float64 `json:"total_ms"`
+	ReusedConn     bool    `json:"reused_connection"`
+}
+
+// httpTimer records the phases of an HTTP request through httptrace. When
+// the request is redirected or repeated, the phases are those of the last
+// round trip, while the total covers all of them.
+type httpTimer struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+func newHTTPTimer() *httpTimer {
+	return &httpTimer{start: time.Now()}
+}
+
+// withTrace attaches the timer to the request context.
+func (t *httpTimer) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:  func(string) { t.reset() },
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart: func(string, string) {
+			// Only the first dial is recorded when dialing multiple addresses
+			t.markOnce(&t.connectStart)
+		},
+		ConnectDone:          func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart:    func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn:              func(info httptrace.GotConnInfo) { t.setReused(info.Reused) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.firstByte) },
+	})
+}
+
+// reset clears the phases of an earlier round trip when a new one starts,
+// so that they are not mixed with those of the next.
+func (t *httpTimer) reset() {
+	t.mu.Lock()
+	t.dnsStart, t.dnsDone = time.Time{}, time.Time{}
+	t.connectStart, t.connectDone = time.Time{}, time.Time{}
+	t.tlsStart, t.tlsDone = time.Time{}, time.Time{}
+	t.wroteRequest, t.firstByte = time.Time{}, time.Time{}
+	t.reused = false
+	t.mu.Unlock()
+}
+
+func (t *httpTimer) mark(field *time.Time) {
+	t.mu.Lock()
+	*field = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *httpTimer) markOnce(field *time.Time) {
+	t.mu.Lock()
+	if field.IsZero() {
+		*field = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *httpTimer) setReused(reused bool) {
+	t.mu.Lock()
+	t.reused = reused
+	t.mu.Unlock()
+}
+
+// timings returns the phase durations, treating end as the moment the body
+// was fully read.
+func (t *httpTimer) timings(end time.Time) *HTTPTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &HTTPTimings{
+		DNSLookupMS:    phaseMS(t.dnsStart, t.dnsDone),
+		TCPConnectMS:   phaseMS(t.connectStart, t.connectDone),
+		TLSHandshakeMS: phaseMS(t.tlsStart, t.tlsDone),
+		TTFBMS:         phaseMS(t.wroteRequest, t.firstByte),
+		TransferMS:     phaseMS(t.firstByte, end),
+		TotalMS:        phaseMS(t.start, end),
+		ReusedConn:     t.reused,
+	}
+}
+
+func phaseMS(start, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds() * 1000
+}
@@ -0,0 +1,235 @@
+package checks
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func init() {
+	Register("tls", "Performs a TLS handshake and validates the certificate chain and expiry", tlsOptionsSchema, CheckRunnerFunc(runTLS))
+}
+
+const tlsOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "host, host:port or https URL"},
+		"tls": {
+			"type": "object",
+			"properties": {
+				"server_name": {"type": "string"},
+				"min_days_remaining": {"type": "integer", "minimum": 0}
+			}
+		}
+	}
+}`
+
+type TLSOptions struct {
+	// ServerName overrides the SNI and the hostname the certificate is verified against
+	ServerName string `json:"server_name,omitempty"`
+	// MinDaysRemaining marks the check as down when the certificate expires sooner
+	MinDaysRemaining int `json:"min_days_remaining,omitempty"`
+}
+
+type CertificateInfo struct {
+	// ServerName is the name the certificate was verified against
+	ServerName    string    `json:"server_name,omitempty"`
+	Subject       string    `json:"subject"`
+	Issuer        string    `json:"issuer"`
+	SANs          []string  `json:"sans,omitempty"`
+	SerialNumber  string    `json:"serial_number"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+	Protocol      string    `json:"protocol"`
+	CipherSuite   string    `json:"cipher_suite"`
+	OCSPStapled   bool      `json:"ocsp_stapled"`
+	OCSPStatus    string    `json:"ocsp_status,omitempty"`
+	ChainValid    bool      `json:"chain_valid"`
+	ChainError    string    `json:"chain_error,omitempty"`
+}
+
+func runTLS(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+	opts := TLSOptions{}
+	if job.TLS != nil {
+		opts = *job.TLS
+	}
+
+	addr, host, err := tlsTargetAddress(job.Target)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	serverName := host
+	if opts.ServerName != "" {
+		serverName = opts.ServerName
+	}
+
+	timeout := jobTimeoutDuration(job)
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Verification is done after the handshake so that details of invalid
+	// certificates can still be reported.
+	dial := env.Egress.DialContext(&net.Dialer{Timeout: timeout})
+
+	start := time.Now()
+	rawConn, err := dial(reqCtx, "tcp", addr)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	defer conn.Close()
+	err = conn.HandshakeContext(reqCtx)
+	dur := time.Since(start).Seconds() * 1000
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	info := inspectConnectionState(conn.ConnectionState(), serverName, true)
+	result := Result{
+		Outpost:     reg,
+		Type:        job.Type,
+		Target:      job.Target,
+		LatencyMS:   dur,
+		Certificate: info,
+		Timestamp:   time.Now().UTC(),
+	}
+
+	switch {
+	case info == nil:
+		result.Error = "no certificate presented"
+	case !info.ChainValid:
+		result.Error = info.ChainError
+	case info.OCSPStatus == "revoked":
+		result.Error = "certificate has been revoked"
+	case opts.MinDaysRemaining > 0 && info.DaysRemaining < opts.MinDaysRemaining:
+		result.Error = fmt.Sprintf("certificate expires in %d days, minimum is %d", info.DaysRemaining, opts.MinDaysRemaining)
+	default:
+		result.Up = true
+	}
+	return result
+}
+
+// tlsTargetAddress accepts a host, host:port or https URL and returns the
+// address to dial along with the hostname.
+func tlsTargetAddress(raw string) (string, string, error) {
+	target := strings.TrimSpace(raw)
+	if target == "" {
+		return "", "", fmt.Errorf("target is required")
+	}
+
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", "", err
+		}
+		target = u.Host
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = strings.Trim(target, "[]")
+		port = "443"
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("invalid target: %q", raw)
+	}
+	return net.JoinHostPort(host, port), host, nil
+}
+
+// inspectConnectionState describes the leaf certificate and negotiated
+// parameters of a TLS connection. When verify is set, the chain is verified
+// against the system roots and the given server name, otherwise it is left
+// unverified and ChainValid is false without a ChainError.
+func inspectConnectionState(state tls.ConnectionState, serverName string, verify bool) *CertificateInfo {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+
+	info := &CertificateInfo{
+		ServerName:    serverName,
+		Subject:       leaf.Subject.String(),
+		Issuer:        leaf.Issuer.String(),
+		SANs:          certificateSANs(leaf),
+		SerialNumber:  leaf.SerialNumber.String(),
+		NotBefore:     leaf.NotBefore.UTC(),
+		NotAfter:      leaf.NotAfter.UTC(),
+		DaysRemaining: int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24)),
+		Protocol:      tls.VersionName(state.Version),
+		CipherSuite:   tls.CipherSuiteName(state.CipherSuite),
+		OCSPStapled:   len(state.OCSPResponse) > 0,
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	var chains [][]*x509.Certificate
+	if verify {
+		var err error
+		chains, err = leaf.Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			info.ChainError = err.Error()
+		} else {
+			info.ChainValid = true
+		}
+	}
+
+	if info.OCSPStapled {
+		var issuer *x509.Certificate
+		if len(chains) > 0 && len(chains[0]) > 1 {
+			issuer = chains[0][1]
+		} else if len(state.PeerCertificates) > 1 {
+			issuer = state.PeerCertificates[1]
+		}
+		info.OCSPStatus = ocspStatus(state.OCSPResponse, issuer)
+	}
+
+	return info
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func ocspStatus(raw []byte, issuer *x509.Certificate) string {
+	resp, err := ocsp.ParseResponse(raw, issuer)
+	if err != nil {
+		return "invalid"
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
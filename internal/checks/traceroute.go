@@ -0,0 +1,510 @@
+package checks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func init() {
+	Register("traceroute", "Traces the network path to a host", tracerouteOptionsSchema, CheckRunnerFunc(runTraceroute))
+}
+
+const tracerouteOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "hostname or IP address"},
+		"traceroute": {
+			"type": "object",
+			"properties": {
+				"protocol": {"enum": ["icmp", "udp", "tcp"], "default": "icmp"},
+				"max_hops": {"type": "integer", "minimum": 1, "maximum": 64, "default": 30},
+				"probes_per_hop": {"type": "integer", "minimum": 1, "maximum": 10, "default": 3},
+				"probe_timeout_ms": {"type": "integer", "default": 1000},
+				"port": {"type": "integer", "minimum": 1, "maximum": 65535}
+			}
+		}
+	}
+}`
+
+const (
+	defaultTracerouteTimeoutSeconds = 60
+	defaultTracerouteMaxHops        = 30
+	maxTracerouteMaxHops            = 64
+	defaultTracerouteProbes         = 3
+	maxTracerouteProbes             = 10
+	defaultTracerouteProbeTimeoutMS = 1000
+	defaultTracerouteUDPPort        = 33434
+	defaultTracerouteTCPPort        = 80
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	reverseLookupTimeout = 2 * time.Second
+)
+
+type TracerouteOptions struct {
+	// Protocol is icmp (default), udp or tcp
+	Protocol       string `json:"protocol,omitempty"`
+	MaxHops        int    `json:"max_hops,omitempty"`
+	ProbesPerHop   int    `json:"probes_per_hop,omitempty"`
+	ProbeTimeoutMS int    `json:"probe_timeout_ms,omitempty"`
+	// Port is the destination port for udp and tcp probes; udp probes
+	// increment it per probe when unset
+	Port int `json:"port,omitempty"`
+}
+
+type TracerouteHop struct {
+	TTL         int       `json:"ttl"`
+	Address     string    `json:"address,omitempty"`
+	Hostname    string    `json:"hostname,omitempty"`
+	RTTsMS      []float64 `json:"rtts_ms"`
+	AvgMS       float64   `json:"avg_ms"`
+	LossPercent float64   `json:"loss_percent"`
+}
+
+// probeReply is the outcome of a single traceroute probe.
+type probeReply struct {
+	peer     net.IP
+	rtt      time.Duration
+	reached  bool
+	terminal bool
+}
+
+type tracer struct {
+	target       net.IP
+	isV6         bool
+	protocol     string
+	port         int
+	probeTimeout time.Duration
+	conn         *icmp.PacketConn
+	echoID       int
+	seq          int
+}
+
+func runTraceroute(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+	opts := TracerouteOptions{}
+	if job.Traceroute != nil {
+		opts = *job.Traceroute
+	}
+
+	target, err := sanitizePingTarget(job.Target)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	protocol := strings.ToLower(opts.Protocol)
+	if protocol == "" {
+		protocol = "icmp"
+	}
+	if protocol != "icmp" && protocol != "udp" && protocol != "tcp" {
+		return fail(job, reg, fmt.Errorf("unsupported protocol: %q", opts.Protocol))
+	}
+
+	maxHops := defaultTracerouteMaxHops
+	if opts.MaxHops > 0 {
+		maxHops = min(opts.MaxHops, maxTracerouteMaxHops)
+	}
+	probes := defaultTracerouteProbes
+	if opts.ProbesPerHop > 0 {
+		probes = min(opts.ProbesPerHop, maxTracerouteProbes)
+	}
+	probeTimeout := time.Duration(defaultTracerouteProbeTimeoutMS) * time.Millisecond
+	if opts.ProbeTimeoutMS > 0 {
+		probeTimeout = time.Duration(opts.ProbeTimeoutMS) * time.Millisecond
+	}
+
+	// A full trace takes much longer than a single check, so it gets its
+	// own default timeout.
+	timeout := time.Duration(defaultTracerouteTimeoutSeconds) * time.Second
+	if job.Timeout > 0 {
+		timeout = jobTimeoutDuration(job)
+	}
+	traceCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ip, err := resolveTargetIP(traceCtx, env.Egress, target)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	t := &tracer{
+		target:       ip,
+		isV6:         ip.To4() == nil,
+		protocol:     protocol,
+		port:         opts.Port,
+		probeTimeout: probeTimeout,
+		echoID:       rand.Intn(0xffff),
+	}
+	if t.port == 0 && protocol == "tcp" {
+		t.port = defaultTracerouteTCPPort
+	}
+
+	// Time exceeded messages are only delivered to raw sockets
+	network, address := "ip4:icmp", "0.0.0.0"
+	if t.isV6 {
+		network, address = "ip6:ipv6-icmp", "::"
+	}
+	t.conn, err = icmp.ListenPacket(network, address)
+	if err != nil {
+		return fail(job, reg, fmt.Errorf("traceroute requires raw ICMP sockets (CAP_NET_RAW): %w", err))
+	}
+	defer t.conn.Close()
+
+	start := time.Now()
+	var hops []TracerouteHop
+	reached := false
+	var traceErr error
+
+trace:
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		hop := TracerouteHop{TTL: ttl, RTTsMS: []float64{}}
+		terminal := false
+		for i := 0; i < probes; i++ {
+			if traceCtx.Err() != nil {
+				traceErr = fmt.Errorf("traceroute timed out after %s", timeout)
+				if len(hop.RTTsMS) > 0 || i > 0 {
+					hops = append(hops, finishHop(hop, i))
+				}
+				break trace
+			}
+
+			reply, err := t.probe(traceCtx, ttl)
+			if err != nil {
+				traceErr = err
+				break trace
+			}
+			if reply == nil {
+				continue
+			}
+			if hop.Address == "" {
+				hop.Address = reply.peer.String()
+			}
+			hop.RTTsMS = append(hop.RTTsMS, reply.rtt.Seconds()*1000)
+			reached = reached || reply.reached
+			terminal = terminal || reply.terminal
+		}
+		hops = append(hops, finishHop(hop, probes))
+		if reached || terminal {
+			break
+		}
+	}
+
+	// Reverse lookups share the trace's deadline, a trace that used all of
+	// it reports its hops without names
+	resolveHopNames(traceCtx, hops)
+
+	result := Result{
+		Outpost:   reg,
+		Type:      job.Type,
+		Target:    target,
+		Up:        reached,
+		LatencyMS: time.Since(start).Seconds() * 1000,
+		Hops:      hops,
+		Timestamp: time.Now().UTC(),
+	}
+	switch {
+	case traceErr != nil:
+		result.Error = traceErr.Error()
+	case !reached:
+		result.Error = fmt.Sprintf("destination %s not reached", ip)
+	}
+	if reached && len(hops) > 0 {
+		result.LatencyMS = hops[len(hops)-1].AvgMS
+	}
+	return result
+}
+
+func finishHop(hop TracerouteHop, sent int) TracerouteHop {
+	if sent == 0 {
+		return hop
+	}
+	var sum float64
+	for _, rtt := range hop.RTTsMS {
+		sum += rtt
+	}
+	if len(hop.RTTsMS) > 0 {
+		hop.AvgMS = sum / float64(len(hop.RTTsMS))
+	}
+	hop.LossPercent = float64(sent-len(hop.RTTsMS)) / float64(sent) * 100
+	return hop
+}
+
+// resolveHopNames fills in the reverse DNS name of every hop concurrently.
+func resolveHopNames(ctx context.Context, hops []TracerouteHop) {
+	var wg sync.WaitGroup
+	for i := range hops {
+		if hops[i].Address == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(hop *TracerouteHop) {
+			defer wg.Done()
+			lookupCtx, cancel := context.WithTimeout(ctx, reverseLookupTimeout)
+			defer cancel()
+			names, err := net.DefaultResolver.LookupAddr(lookupCtx, hop.Address)
+			if err == nil && len(names) > 0 {
+				hop.Hostname = strings.TrimSuffix(names[0], ".")
+			}
+		}(&hops[i])
+	}
+	wg.Wait()
+}
+
+// probe sends a single probe with the given TTL and waits for the matching
+// ICMP reply. It returns nil when the probe timed out.
+func (t *tracer) probe(ctx context.Context, ttl int) (*probeReply, error) {
+	t.seq++
+	deadline := time.Now().Add(t.probeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	switch t.protocol {
+	case "udp":
+		return t.probeUDP(ttl, deadline)
+	case "tcp":
+		return t.probeTCP(ctx, ttl, deadline)
+	default:
+		return t.probeICMP(ttl, deadline)
+	}
+}
+
+func (t *tracer) probeICMP(ttl int, deadline time.Time) (*probeReply, error) {
+	var echoType icmp.Type = ipv4.ICMPTypeEcho
+	if t.isV6 {
+		echoType = ipv6.ICMPTypeEchoRequest
+		if err := t.conn.IPv6PacketConn().SetHopLimit(ttl); err != nil {
+			return nil, err
+		}
+	} else if err := t.conn.IPv4PacketConn().SetTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: t.echoID, Seq: t.seq, Data: []byte("vigilant-traceroute")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := time.Now()
+	if _, err := t.conn.WriteTo(b, &net.IPAddr{IP: t.target}); err != nil {
+		return nil, fmt.Errorf("failed to send probe: %w", err)
+	}
+
+	return t.awaitReply(sent, deadline, func(msg *icmp.Message) bool {
+		echo, ok := msg.Body.(*icmp.Echo)
+		return ok && echo.ID == t.echoID && echo.Seq == t.seq
+	}, func(proto int, transport []byte) bool {
+		return (proto == protocolICMP || proto == protocolICMPv6) &&
+			int(binary.BigEndian.Uint16(transport[4:6])) == t.echoID &&
+			int(binary.BigEndian.Uint16(transport[6:8])) == t.seq&0xffff
+	})
+}
+
+func (t *tracer) probeUDP(ttl int, deadline time.Time) (*probeReply, error) {
+	network := "udp4"
+	if t.isV6 {
+		network = "udp6"
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if t.isV6 {
+		err = ipv6.NewPacketConn(conn).SetHopLimit(ttl)
+	} else {
+		err = ipv4.NewPacketConn(conn).SetTTL(ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	port := t.port
+	if port == 0 {
+		port = defaultTracerouteUDPPort + t.seq - 1
+	}
+
+	sent := time.Now()
+	if _, err := conn.WriteTo([]byte("vigilant-traceroute"), &net.UDPAddr{IP: t.target, Port: port}); err != nil {
+		return nil, fmt.Errorf("failed to send probe: %w", err)
+	}
+
+	return t.awaitReply(sent, deadline, nil, func(proto int, transport []byte) bool {
+		return proto == protocolUDP && int(binary.BigEndian.Uint16(transport[2:4])) == port
+	})
+}
+
+func (t *tracer) probeTCP(ctx context.Context, ttl int, deadline time.Time) (*probeReply, error) {
+	dialCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	type dialResult struct {
+		at  time.Time
+		err error
+	}
+	dialed := make(chan dialResult, 1)
+	sent := time.Now()
+	go func() {
+		dialer := &net.Dialer{Control: setTTLControl(ttl)}
+		conn, err := dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(t.target.String(), strconv.Itoa(t.port)))
+		if conn != nil {
+			conn.Close()
+		}
+		dialed <- dialResult{at: time.Now(), err: err}
+	}()
+
+	type icmpResult struct {
+		reply *probeReply
+		err   error
+	}
+	replied := make(chan icmpResult, 1)
+	go func() {
+		reply, err := t.awaitReply(sent, deadline, nil, func(proto int, transport []byte) bool {
+			return proto == protocolTCP && int(binary.BigEndian.Uint16(transport[2:4])) == t.port
+		})
+		replied <- icmpResult{reply, err}
+	}()
+	// Unblock the ICMP reader when the dial decides the probe first
+	gotReply := false
+	defer func() {
+		if !gotReply {
+			t.conn.SetReadDeadline(time.Now())
+			<-replied
+		}
+	}()
+
+	for {
+		select {
+		case d := <-dialed:
+			// A completed or refused handshake means the SYN reached the target
+			if d.err == nil || errors.Is(d.err, syscall.ECONNREFUSED) {
+				return &probeReply{peer: t.target, rtt: d.at.Sub(sent), reached: true, terminal: true}, nil
+			}
+			// Otherwise the ICMP reader may still identify the hop
+			dialed = nil
+		case r := <-replied:
+			gotReply = true
+			return r.reply, r.err
+		}
+	}
+}
+
+// awaitReply reads ICMP messages until one matches the outstanding probe or
+// the deadline passes. matchEcho matches direct echo replies, matchQuoted
+// matches the original packet quoted in time exceeded and destination
+// unreachable messages.
+func (t *tracer) awaitReply(sent, deadline time.Time, matchEcho func(*icmp.Message) bool, matchQuoted func(proto int, transport []byte) bool) (*probeReply, error) {
+	proto := protocolICMP
+	if t.isV6 {
+		proto = protocolICMPv6
+	}
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		received := time.Now()
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		peerIP := addrIP(peer)
+
+		switch msg.Type {
+		case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+			if matchEcho != nil && matchEcho(msg) {
+				return &probeReply{peer: peerIP, rtt: received.Sub(sent), reached: true, terminal: true}, nil
+			}
+		case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+			body, ok := msg.Body.(*icmp.TimeExceeded)
+			if ok && t.matchQuoted(body.Data, matchQuoted) {
+				return &probeReply{peer: peerIP, rtt: received.Sub(sent)}, nil
+			}
+		case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+			body, ok := msg.Body.(*icmp.DstUnreach)
+			if ok && t.matchQuoted(body.Data, matchQuoted) {
+				return &probeReply{
+					peer:     peerIP,
+					rtt:      received.Sub(sent),
+					reached:  peerIP.Equal(t.target),
+					terminal: true,
+				}, nil
+			}
+		}
+	}
+}
+
+// matchQuoted parses the original IP header and the first bytes of the
+// transport header quoted in an ICMP error and hands them to match when the
+// packet was addressed to the trace target.
+func (t *tracer) matchQuoted(data []byte, match func(proto int, transport []byte) bool) bool {
+	var proto int
+	var dst net.IP
+	var transport []byte
+
+	if t.isV6 {
+		if len(data) < ipv6.HeaderLen {
+			return false
+		}
+		proto = int(data[6])
+		dst = net.IP(data[24:40])
+		transport = data[ipv6.HeaderLen:]
+	} else {
+		if len(data) < ipv4.HeaderLen {
+			return false
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		if len(data) < headerLen {
+			return false
+		}
+		proto = int(data[9])
+		dst = net.IP(data[16:20])
+		transport = data[headerLen:]
+	}
+
+	if len(transport) < 8 || !dst.Equal(t.target) {
+		return false
+	}
+	return match(proto, transport)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,129 @@
+package checks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+func init() {
+	Register("udp", "Sends a UDP datagram and waits for a matching reply", udpOptionsSchema, CheckRunnerFunc(runUDP))
+}
+
+const udpOptionsSchema = `{
+	"type": "object",
+	"required": ["target"],
+	"properties": {
+		"target": {"type": "string", "description": "host:port to send to"},
+		"udp": {
+			"type": "object",
+			"properties": {
+				"send": {"type": "string"},
+				"send_hex": {"type": "string"},
+				"expect": {"type": "string"},
+				"expect_regex": {"type": "string"},
+				"expect_hex": {"type": "string"},
+				"read_timeout_ms": {"type": "integer"}
+			}
+		}
+	}
+}`
+
+type UDPOptions struct {
+	ExchangeOptions
+}
+
+func runUDP(ctx context.Context, env *Env, job Job) Result {
+	reg := env.Outpost
+	start := time.Now()
+
+	timeout := jobTimeoutDuration(job)
+	deadline := start.Add(timeout)
+
+	var exchange *ExchangeOptions
+	if job.UDP != nil {
+		exchange = &job.UDP.ExchangeOptions
+	}
+	payload, err := exchange.payload()
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	matcher, err := exchange.matcher()
+	if err != nil {
+		return fail(job, reg, err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+
+	// A connected socket reports ICMP port unreachable as ECONNREFUSED
+	conn, err := env.Egress.DialContext(dialer)(ctx, "udp", job.Target)
+	if err != nil {
+		return fail(job, reg, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(payload); err != nil {
+		return fail(job, reg, udpError(err))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(exchange.readTimeout(time.Until(deadline))))
+	resp, err := readDatagram(conn, matcher)
+	dur := time.Since(start).Seconds() * 1000
+	if err != nil && len(resp) == 0 {
+		return fail(job, reg, udpError(err))
+	}
+
+	result := Result{
+		Outpost:   reg,
+		Type:      job.Type,
+		Target:    job.Target,
+		LatencyMS: dur,
+		Response:  formatResponse(resp),
+		Timestamp: time.Now().UTC(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Up = true
+	return result
+}
+
+// readDatagram waits for a datagram that satisfies the matcher. Without
+// expectations the first datagram is accepted. When no datagram matches,
+// the last one received is returned along with the mismatch.
+func readDatagram(conn net.Conn, matcher *responseMatcher) ([]byte, error) {
+	var last []byte
+	var mismatch error
+	buf := make([]byte, maxResponseBytes)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if mismatch != nil {
+				return last, mismatch
+			}
+			return nil, err
+		}
+		last = append(last[:0], buf[:n]...)
+		if mismatch = matcher.match(last); mismatch == nil {
+			return last, nil
+		}
+	}
+}
+
+func udpError(err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("port unreachable: %w", err)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("no response received: %w", err)
+	}
+	return err
+}
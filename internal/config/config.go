@@ -1,12 +1,15 @@
 package config
 
 import (
+	crand "crypto/rand"
+	"encoding/hex"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -22,15 +25,64 @@ type Config struct {
 	Longitude             float64
 	OutpostSecret         string
 	InactivityTimeoutMins int
+	MTLSMode              string
+	MTLSReplacesSecret    bool
+	CertRenewBeforeHours  int
+	DataDir               string
+	OutpostID             string
+	HeartbeatIntervalSecs int
+	Mode                  string
+	PullWaitSecs          int
+	MaxConcurrency        int
+	Labels                map[string]string
+	QueueSize             int
+	TypeConcurrency       map[string]int
+	EgressBlockPrivate    bool
+	EgressAllowCIDRs      []string
+	EgressDenyCIDRs       []string
+	EgressAllowHosts      []string
+	EgressDenyHosts       []string
+	EgressTrustProxies    bool
+	RequireSignature      bool
+	SignatureMaxSkewSecs  int
 }
 
+// Client certificate verification modes for MTLSMode
+const (
+	MTLSOff     = "off"
+	MTLSVerify  = "verify"
+	MTLSRequire = "require"
+)
+
+// Outpost modes for Mode
+const (
+	// ModePush listens for checks sent by Vigilant
+	ModePush = "push"
+	// ModePull polls Vigilant for checks, for outposts that are not reachable
+	ModePull = "pull"
+)
+
 func Load() *Config {
 	vigilantURL := os.Getenv("VIGILANT_URL")
 	outpostSecret := os.Getenv("OUTPOST_SECRET")
-	hostname := getHostname()
-	port := getPort(hostname)
+	dataDir := getDataDir()
+	hostname := getHostname(dataDir)
+	port := getPort(dataDir)
+	outpostID := getOutpostID(dataDir)
 	ip := getPublicIP()
 	inactivityTimeoutMins := getInactivityTimeoutMins()
+	mtlsMode := getMTLSMode()
+	mtlsReplacesSecret := getBool("MTLS_REPLACES_SECRET", false)
+	certRenewBeforeHours := getCertRenewBeforeHours()
+	heartbeatIntervalSecs := getHeartbeatIntervalSecs()
+	mode := getMode()
+	pullWaitSecs := getPullWaitSecs()
+	maxConcurrency := getMaxConcurrency()
+	labels := getLabels()
+	queueSize := getQueueSize()
+	typeConcurrency := getTypeConcurrency()
+	egressBlockPrivate := getBool("EGRESS_BLOCK_PRIVATE", true)
+	egressTrustProxies := getBool("EGRESS_TRUST_PROXIES", false)
 	country := strings.TrimSpace(os.Getenv("COUNTRY"))
 	latitudeStr := strings.TrimSpace(os.Getenv("LATITUDE"))
 	longitudeStr := strings.TrimSpace(os.Getenv("LONGITUDE"))
@@ -38,7 +90,7 @@ func Load() *Config {
 	var latitude float64
 	if latitudeStr != "" {
 		if parsed, err := strconv.ParseFloat(latitudeStr, 64); err != nil {
-			log.Printf("invalid LATITUDE value %q: %v", latitudeStr, err)
+			slog.Warn("invalid LATITUDE value", "value", latitudeStr, "error", err)
 		} else {
 			latitude = parsed
 		}
@@ -47,19 +99,37 @@ func Load() *Config {
 	var longitude float64
 	if longitudeStr != "" {
 		if parsed, err := strconv.ParseFloat(longitudeStr, 64); err != nil {
-			log.Printf("invalid LONGITUDE value %q: %v", longitudeStr, err)
+			slog.Warn("invalid LONGITUDE value", "value", longitudeStr, "error", err)
 		} else {
 			longitude = parsed
 		}
 	}
 
 	if ip == "" {
-		log.Printf("IP address could not be determined, exiting")
+		slog.Error("IP address could not be determined, exiting")
 		os.Exit(1)
 	}
 
-	log.Printf("Configuration: IP=%s, Port=%d, Hostname=%s, VigilantURL=%s, Country=%s, Latitude=%f, Longitude=%f, InactivityTimeout=%dmins",
-		ip, port, hostname, vigilantURL, country, latitude, longitude, inactivityTimeoutMins)
+	slog.Info("loaded configuration",
+		"outpost_id", outpostID,
+		"mode", mode,
+		"ip", ip,
+		"port", port,
+		"hostname", hostname,
+		"vigilant_url", vigilantURL,
+		"country", country,
+		"latitude", latitude,
+		"longitude", longitude,
+		"inactivity_timeout_mins", inactivityTimeoutMins,
+		"mtls_mode", mtlsMode,
+		"data_dir", dataDir,
+		"max_concurrency", maxConcurrency,
+		"queue_size", queueSize,
+		"type_concurrency", typeConcurrency,
+		"egress_block_private", egressBlockPrivate,
+		"egress_trust_proxies", egressTrustProxies,
+		"labels", labels,
+	)
 
 	return &Config{
 		VigilantURL:           vigilantURL,
@@ -71,22 +141,63 @@ func Load() *Config {
 		Longitude:             longitude,
 		OutpostSecret:         outpostSecret,
 		InactivityTimeoutMins: inactivityTimeoutMins,
+		MTLSMode:              mtlsMode,
+		MTLSReplacesSecret:    mtlsReplacesSecret,
+		CertRenewBeforeHours:  certRenewBeforeHours,
+		DataDir:               dataDir,
+		OutpostID:             outpostID,
+		HeartbeatIntervalSecs: heartbeatIntervalSecs,
+		Mode:                  mode,
+		PullWaitSecs:          pullWaitSecs,
+		MaxConcurrency:        maxConcurrency,
+		Labels:                labels,
+		QueueSize:             queueSize,
+		TypeConcurrency:       typeConcurrency,
+		EgressBlockPrivate:    egressBlockPrivate,
+		EgressAllowCIDRs:      getList("EGRESS_ALLOW_CIDRS"),
+		EgressDenyCIDRs:       getList("EGRESS_DENY_CIDRS"),
+		EgressAllowHosts:      getList("EGRESS_ALLOW_HOSTS"),
+		EgressDenyHosts:       getList("EGRESS_DENY_HOSTS"),
+		EgressTrustProxies:    egressTrustProxies,
+		RequireSignature:      getBool("REQUIRE_SIGNATURE", false),
+		SignatureMaxSkewSecs:  getSignatureMaxSkewSecs(),
 	}
 }
 
-func getHostname() string {
+// LogLevel returns the minimum level of log lines from LOG_LEVEL, one of
+// debug, info, warn or error. It is read separately from Load so that
+// logging can be set up before the configuration is loaded.
+func LogLevel() slog.Level {
+	var level slog.Level
+	if v := strings.TrimSpace(os.Getenv("LOG_LEVEL")); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			return slog.LevelInfo
+		}
+	}
+	return level
+}
+
+// LogFormat returns the log output format from LOG_FORMAT, json or text.
+func LogFormat() string {
+	if strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))) == "text" {
+		return "text"
+	}
+	return "json"
+}
+
+func getHostname(dataDir string) string {
 	containerName := getDockerContainerName()
 	if containerName != "" {
-		storeHostname(containerName)
+		storeHostname(dataDir, containerName)
 		return containerName
 	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Printf("failed to get system hostname: %v", err)
+		slog.Warn("failed to get system hostname", "error", err)
 		hostname = "unknown"
 	}
-	storeHostname(hostname)
+	storeHostname(dataDir, hostname)
 	return hostname
 }
 
@@ -120,34 +231,128 @@ func getDockerContainerName() string {
 	return ""
 }
 
-func storeHostname(hostname string) {
+// containerIDPattern matches the Docker container directory that /etc/hostname
+// and /etc/resolv.conf are mounted from.
+var containerIDPattern = regexp.MustCompile(`/containers/([0-9a-f]{64})/`)
+
+// getContainerID returns the short ID of the Docker container the outpost
+// runs in, or an empty string outside of Docker. Unlike the hostname, it is
+// distinct even for containers sharing the host network.
+func getContainerID() string {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ""
+	}
+	m := containerIDPattern.FindSubmatch(data)
+	if m == nil {
+		return ""
+	}
+	return string(m[1][:12])
+}
+
+// getDataDir returns the directory used to persist state across restarts,
+// falling back to a local directory when the default is not writable. Each
+// replica gets its own subdirectory when REPLICA_ID is set, as replicas share
+// the data volume. When REPLICA_ID is an unexpanded template, the container
+// ID is used instead so that replicas never share their port and outpost ID. It returns an empty string when no directory can be created.
+func getDataDir() string {
 	dataDir := "/var/lib/uptime-outpost"
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		dataDir = ".outpost-data"
 		if err := os.MkdirAll(dataDir, 0755); err != nil {
-			log.Printf("failed to create data directory: %v", err)
-			return
+			slog.Error("failed to create data directory", "error", err)
+			return ""
 		}
 	}
 
+	// Outside of swarm mode the compose template is passed through unresolved
+	replicaID := strings.TrimSpace(os.Getenv("REPLICA_ID"))
+	if strings.Contains(replicaID, "{{") {
+		replicaID = getContainerID()
+		if replicaID == "" {
+			slog.Warn("REPLICA_ID is an unexpanded template and no container ID was found, using the shared data directory", "data_dir", dataDir)
+			return dataDir
+		}
+		slog.Warn("REPLICA_ID is an unexpanded template, using the container ID instead, state is kept only as long as the container", "replica_id", replicaID)
+	}
+	if replicaID != "" {
+		replicaDir := filepath.Join(dataDir, "replica-"+filepath.Base(replicaID))
+		if err := os.MkdirAll(replicaDir, 0755); err != nil {
+			slog.Error("failed to create replica data directory", "error", err)
+			return dataDir
+		}
+		return replicaDir
+	}
+	return dataDir
+}
+
+func storeHostname(dataDir, hostname string) {
+	if dataDir == "" {
+		return
+	}
+
 	hostnameFile := filepath.Join(dataDir, "hostname")
 	if err := os.WriteFile(hostnameFile, []byte(hostname), 0644); err != nil {
-		log.Printf("failed to write hostname file: %v", err)
+		slog.Warn("failed to write hostname file", "error", err)
 	}
 }
 
-func getPort(hostname string) int {
+// getPort returns the configured port, or the port chosen on a previous
+// start so that the outpost keeps its address across restarts.
+func getPort(dataDir string) int {
 	if p := os.Getenv("PORT"); p != "" {
 		if parsed, err := strconv.Atoi(p); err == nil {
 			return parsed
 		}
 	}
 
+	portFile := filepath.Join(dataDir, "port")
+	if dataDir != "" {
+		if data, err := os.ReadFile(portFile); err == nil {
+			if parsed, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && parsed > 0 && parsed < 65536 {
+				return parsed
+			}
+		}
+	}
+
 	rand.Seed(time.Now().UnixNano())
 	port := 1000 + rand.Intn(9001)
+
+	if dataDir != "" {
+		if err := os.WriteFile(portFile, []byte(strconv.Itoa(port)), 0644); err != nil {
+			slog.Warn("failed to write port file", "error", err)
+		}
+	}
 	return port
 }
 
+// getOutpostID returns the stable identifier of this outpost, generating and
+// storing one on first start.
+func getOutpostID(dataDir string) string {
+	idFile := filepath.Join(dataDir, "outpost-id")
+	if dataDir != "" {
+		if data, err := os.ReadFile(idFile); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		slog.Error("failed to generate outpost ID", "error", err)
+		return ""
+	}
+	id := hex.EncodeToString(b)
+
+	if dataDir != "" {
+		if err := os.WriteFile(idFile, []byte(id), 0644); err != nil {
+			slog.Warn("failed to write outpost ID file", "error", err)
+		}
+	}
+	return id
+}
+
 func getInactivityTimeoutMins() int {
 	if t := os.Getenv("INACTIVITY_TIMEOUT_MINS"); t != "" {
 		if parsed, err := strconv.Atoi(t); err == nil && parsed > 0 {
@@ -157,6 +362,150 @@ func getInactivityTimeoutMins() int {
 	return 60 // Default to 60 minutes (1 hour)
 }
 
+func getCertRenewBeforeHours() int {
+	if h := os.Getenv("CERT_RENEW_BEFORE_HOURS"); h != "" {
+		if parsed, err := strconv.Atoi(h); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 0 // Renew after two thirds of the certificate lifetime
+}
+
+func getHeartbeatIntervalSecs() int {
+	if s := os.Getenv("HEARTBEAT_INTERVAL_SECS"); s != "" {
+		if parsed, err := strconv.Atoi(s); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return 60 // Zero disables heartbeats
+}
+
+func getPullWaitSecs() int {
+	if s := os.Getenv("PULL_WAIT_SECS"); s != "" {
+		if parsed, err := strconv.Atoi(s); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 30
+}
+
+func getMaxConcurrency() int {
+	if s := os.Getenv("MAX_CONCURRENCY"); s != "" {
+		if parsed, err := strconv.Atoi(s); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 32
+}
+
+// getLabels parses LABELS, a comma separated list of key=value pairs such
+// as "provider=hetzner,asn=AS24940,datacenter=fsn1".
+func getLabels() map[string]string {
+	return getKeyValues("LABELS")
+}
+
+// getTypeConcurrency parses TYPE_CONCURRENCY, per check type concurrency
+// limits such as "traceroute=2,icmp=10".
+func getTypeConcurrency() map[string]int {
+	limits := make(map[string]int)
+	for checkType, v := range getKeyValues("TYPE_CONCURRENCY") {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			slog.Warn("ignoring invalid TYPE_CONCURRENCY entry", "type", checkType, "value", v)
+			continue
+		}
+		limits[checkType] = parsed
+	}
+	return limits
+}
+
+func getSignatureMaxSkewSecs() int {
+	if s := os.Getenv("SIGNATURE_MAX_SKEW_SECS"); s != "" {
+		if parsed, err := strconv.Atoi(s); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return 300
+}
+
+func getQueueSize() int {
+	if s := os.Getenv("QUEUE_SIZE"); s != "" {
+		if parsed, err := strconv.Atoi(s); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return 1000
+}
+
+// getList parses a comma separated list.
+func getList(name string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getKeyValues parses a comma separated list of key=value pairs.
+func getKeyValues(name string) map[string]string {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return nil
+	}
+
+	values := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			slog.Warn("ignoring invalid entry", "name", name, "entry", pair)
+			continue
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+func getMode() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("OUTPOST_MODE")))
+	switch mode {
+	case "":
+		return ModePush
+	case ModePush, ModePull:
+		return mode
+	default:
+		slog.Warn("invalid OUTPOST_MODE value, falling back to default", "value", mode, "default", ModePush)
+		return ModePush
+	}
+}
+
+func getMTLSMode() string {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("MTLS_MODE")))
+	switch mode {
+	case "":
+		return MTLSOff
+	case MTLSOff, MTLSVerify, MTLSRequire:
+		return mode
+	default:
+		slog.Warn("invalid MTLS_MODE value, falling back to default", "value", mode, "default", MTLSOff)
+		return MTLSOff
+	}
+}
+
+func getBool(name string, fallback bool) bool {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			slog.Warn("invalid boolean value", "name", name, "value", v, "error", err)
+			return fallback
+		}
+		return parsed
+	}
+	return fallback
+}
+
 func getPublicIP() string {
 	if ip := os.Getenv("IP"); ip != "" {
 		return ip
@@ -171,30 +520,30 @@ func getPublicIP() string {
 		return ipv6
 	}
 
-	log.Printf("failed to get public IP")
+	slog.Error("failed to get public IP")
 	return ""
 }
 
 func fetchPublicIP(url string) string {
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Printf("failed to fetch IP from %s: %v", url, err)
+		slog.Warn("failed to fetch public IP", "url", url, "error", err)
 		return ""
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("unexpected status code from %s: %d", url, resp.StatusCode)
+		slog.Warn("unexpected status code fetching public IP", "url", url, "status", resp.StatusCode)
 		return ""
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("failed to read response from %s: %v", url, err)
+		slog.Warn("failed to read public IP response", "url", url, "error", err)
 		return ""
 	}
 
 	ip := strings.TrimSpace(string(body))
-	log.Printf("fetched public IP: %s", ip)
+	slog.Info("fetched public IP", "ip", ip)
 	return ip
 }
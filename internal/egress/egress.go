@@ -0,0 +1,317 @@
+// Package egress decides which addresses checks may connect to, so that the
+// outpost cannot be used to probe its own network or cloud metadata
+// endpoints.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrDenied is wrapped by the errors returned for targets the policy
+// rejects.
+var ErrDenied = errors.New("denied by egress policy")
+
+// blockedRanges are rejected unless explicitly allowed: addresses that do
+// not belong to the public internet.
+var blockedRanges = mustParseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata endpoints
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b:1::/48", // local-use NAT64
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// translationRanges are IPv6 prefixes that carry an IPv4 address, which is
+// checked like the IPv6 address itself. The offset is where the IPv4
+// address starts.
+var translationRanges = []struct {
+	net    *net.IPNet
+	offset int
+}{
+	{mustParseCIDRs("64:ff9b::/96")[0], 12}, // well-known NAT64 prefix
+	{mustParseCIDRs("2002::/16")[0], 2},     // 6to4
+}
+
+// Policy is the set of rules applied to check targets. The zero value
+// allows everything.
+type Policy struct {
+	// BlockPrivate rejects loopback, link-local, private and other
+	// non-public addresses
+	BlockPrivate bool
+	// AllowCIDRs are exempt from BlockPrivate
+	AllowCIDRs []*net.IPNet
+	// DenyCIDRs are always rejected
+	DenyCIDRs []*net.IPNet
+	// AllowHosts are hostname patterns exempt from BlockPrivate, so that
+	// they may resolve to private addresses
+	AllowHosts []string
+	// DenyHosts are hostname patterns that are always rejected
+	DenyHosts []string
+	// TrustProxies allows checks through a proxy while BlockPrivate is
+	// set. The proxy resolves targets itself, so only their names and IP
+	// literals can be checked, and what the proxy reaches is up to it.
+	TrustProxies bool
+}
+
+// NewPolicy builds a policy from lists of CIDRs or addresses and hostname
+// patterns such as "example.com" or "*.internal".
+func NewPolicy(blockPrivate bool, allowCIDRs, denyCIDRs, allowHosts, denyHosts []string) (*Policy, error) {
+	allowNets, err := parseCIDRs(allowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed CIDR: %w", err)
+	}
+	denyNets, err := parseCIDRs(denyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied CIDR: %w", err)
+	}
+	return &Policy{
+		BlockPrivate: blockPrivate,
+		AllowCIDRs:   allowNets,
+		DenyCIDRs:    denyNets,
+		AllowHosts:   normalizeHosts(allowHosts),
+		DenyHosts:    normalizeHosts(denyHosts),
+	}, nil
+}
+
+// CheckProxy reports whether checks may connect through a proxy, which is
+// refused while private addresses are blocked unless proxies are trusted.
+func (p *Policy) CheckProxy() error {
+	if p == nil || !p.BlockPrivate || p.TrustProxies {
+		return nil
+	}
+	return fmt.Errorf("proxy %w: targets behind a proxy cannot be checked against private address ranges", ErrDenied)
+}
+
+// CheckHost reports whether a hostname may be connected to at all. IP
+// literals are checked against the address rules.
+func (p *Policy) CheckHost(host string) error {
+	if p == nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP("", ip)
+	}
+	if matchHost(p.DenyHosts, host) {
+		return fmt.Errorf("host %s %w", host, ErrDenied)
+	}
+	return nil
+}
+
+// CheckIP reports whether an address, resolved from host when host is not
+// empty, may be connected to.
+func (p *Policy) CheckIP(host string, ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	ips := []net.IP{ip}
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		ips = append(ips, v4)
+	}
+	if host != "" && matchHost(p.DenyHosts, host) {
+		return fmt.Errorf("host %s %w", host, ErrDenied)
+	}
+	if containsIP(p.DenyCIDRs, ips...) {
+		return fmt.Errorf("address %s %w", ip, ErrDenied)
+	}
+	if !p.BlockPrivate || containsIP(p.AllowCIDRs, ips...) || (host != "" && matchHost(p.AllowHosts, host)) {
+		return nil
+	}
+	if containsIP(blockedRanges, ips...) {
+		return fmt.Errorf("address %s %w: not a public address", ip, ErrDenied)
+	}
+	return nil
+}
+
+// Resolve looks up host and returns the addresses the policy allows. It
+// fails when none are allowed.
+func (p *Policy) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if err := p.CheckHost(host); err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []net.IP
+	var firstErr error
+	for _, addr := range addrs {
+		if err := p.CheckIP(host, addr.IP); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		allowed = append(allowed, addr.IP)
+	}
+	if len(allowed) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no addresses found for %s", host)
+		}
+		return nil, firstErr
+	}
+	return allowed, nil
+}
+
+// DialContext returns a dial function that resolves the address with
+// Resolve and connects to the first allowed address that answers. Dialing
+// the resolved address directly means a second, different DNS answer
+// cannot bypass the policy.
+func (p *Policy) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := p.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		var lastErr error
+		for _, ip := range ips {
+			if !matchesNetwork(network, ip) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no %s address found for %s", network, host)
+		}
+		return nil, lastErr
+	}
+}
+
+// matchesNetwork reports whether ip can be dialed on a network such as
+// "tcp4" or "udp".
+func matchesNetwork(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	}
+	return true
+}
+
+// matchHost reports whether host matches one of the patterns. A pattern
+// matches the host itself and, when it starts with "*.", any subdomain.
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// containsIP reports whether any of the addresses is in one of the nets.
+func containsIP(nets []*net.IPNet, ips ...net.IP) bool {
+	for _, n := range nets {
+		for _, ip := range ips {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// embeddedIPv4 returns the IPv4 address carried by a NAT64 or 6to4
+// address, or nil for any other address.
+func embeddedIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+	for _, r := range translationRanges {
+		if r.net.Contains(ip) {
+			return net.IPv4(ip[r.offset], ip[r.offset+1], ip[r.offset+2], ip[r.offset+3]).To4()
+		}
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of CIDRs or single addresses.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// normalizeHosts lower-cases hostname patterns and drops empty entries.
+func normalizeHosts(values []string) []string {
+	var hosts []string
+	for _, v := range values {
+		v = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(v), "."))
+		if v != "" {
+			hosts = append(hosts, v)
+		}
+	}
+	return hosts
+}
+
+func mustParseCIDRs(values ...string) []*net.IPNet {
+	nets, err := parseCIDRs(values)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
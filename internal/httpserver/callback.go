@@ -0,0 +1,203 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vigilant-uptime-outpost/internal/checks"
+	"vigilant-uptime-outpost/internal/egress"
+	"vigilant-uptime-outpost/internal/logging"
+)
+
+const (
+	callbackMaxAttempts    = 5
+	callbackInitialBackoff = time.Second
+	callbackMaxBackoff     = 30 * time.Second
+	callbackTimeout        = 10 * time.Second
+	callbackMaxRedirects   = 10
+
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signatureNonceHeader     = "X-Signature-Nonce"
+
+	// Signatures of requests to the outpost and of callbacks from it cover
+	// different labels, so that one cannot be replayed as the other
+	signatureRequestLabel  = "outpost-request"
+	signatureCallbackLabel = "outpost-callback"
+)
+
+// newCallbackClient returns the client callbacks are delivered with. Like
+// checks, it only connects to addresses the egress policy allows, so a
+// callback URL cannot reach the outpost's own network either.
+func newCallbackClient(policy *egress.Policy) *http.Client {
+	return &http.Client{
+		Timeout: callbackTimeout,
+		Transport: &http.Transport{
+			DialContext: policy.DialContext(&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}),
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= callbackMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", callbackMaxRedirects)
+			}
+			if err := policy.CheckHost(req.URL.Hostname()); err != nil {
+				return fmt.Errorf("redirect to %s: %w", req.URL.Redacted(), err)
+			}
+			return nil
+		},
+	}
+}
+
+// dispatchAsync accepts a job that carries a callback URL, runs it in the
+// background and returns a pending result that identifies the job. The job
+// outlives the request but keeps its request ID for logging.
+func (s *Server) dispatchAsync(ctx context.Context, job checks.Job) checks.Result {
+	jobID := job.ID
+	if jobID == "" {
+		jobID = newJobID()
+	}
+	ctx = logging.WithJobID(logging.WithRequestID(s.jobsCtx, logging.RequestID(ctx)), jobID)
+
+	s.jobsMu.Lock()
+	if s.jobsClosed {
+		s.jobsMu.Unlock()
+		s.checker.Release(1)
+		return checks.Result{
+			Outpost: s.registrar.Info(), JobID: jobID, Type: job.Type, Target: job.Target,
+			Error: "outpost is shutting down", Timestamp: time.Now().UTC(),
+		}
+	}
+	s.jobs.Add(1)
+	s.jobsMu.Unlock()
+	go func() {
+		defer s.jobs.Done()
+		result := s.checker.Run(ctx, job)
+		result.JobID = jobID
+		if err := s.deliverCallback(ctx, job.CallbackURL, result); err != nil {
+			slog.ErrorContext(ctx, "callback failed", "callback_url", job.CallbackURL, "error", err)
+		}
+	}()
+
+	return checks.Result{
+		JobID:     jobID,
+		Pending:   true,
+		Type:      job.Type,
+		Target:    job.Target,
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// callbackStatusError is returned for callbacks answered with an error
+// status.
+type callbackStatusError struct {
+	code   int
+	status string
+}
+
+func (e *callbackStatusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// temporary reports whether the callback may be accepted when retried.
+// Other client errors will not change by sending the same result again.
+func (e *callbackStatusError) temporary() bool {
+	return e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests || e.code >= 500
+}
+
+// deliverCallback POSTs the result to the callback URL, retrying network
+// errors and temporary failures with exponential backoff until it is
+// accepted or the attempts run out.
+func (s *Server) deliverCallback(ctx context.Context, url string, result checks.Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	backoff := callbackInitialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= callbackMaxAttempts; attempt++ {
+		lastErr = s.postCallback(ctx, url, body)
+		if lastErr == nil {
+			return nil
+		}
+		var statusErr *callbackStatusError
+		if errors.As(lastErr, &statusErr) && !statusErr.temporary() {
+			return fmt.Errorf("not retrying: %w", lastErr)
+		}
+		slog.WarnContext(ctx, "callback attempt failed", "attempt", attempt, "max_attempts", callbackMaxAttempts, "error", lastErr)
+		if attempt == callbackMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			if backoff < callbackMaxBackoff {
+				backoff *= 2
+			}
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", callbackMaxAttempts, lastErr)
+}
+
+func (s *Server) postCallback(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Vigilant Bot")
+	if s.cfg.OutpostSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := newJobID()
+		req.Header.Set(signatureTimestampHeader, timestamp)
+		req.Header.Set(signatureNonceHeader, nonce)
+		req.Header.Set(signatureHeader, signPayload(s.cfg.OutpostSecret, signatureCallbackLabel, req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	}
+
+	resp, err := s.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &callbackStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of the label, method,
+// request URI, timestamp, nonce and body, keyed with the outpost secret.
+func signPayload(secret, label, method, requestURI, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, field := range []string{label, method, requestURI, timestamp, nonce} {
+		mac.Write([]byte(field))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -3,50 +3,77 @@ package httpserver
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"vigilant-uptime-outpost/internal/checks"
 	"vigilant-uptime-outpost/internal/config"
+	"vigilant-uptime-outpost/internal/egress"
+	"vigilant-uptime-outpost/internal/logging"
+	"vigilant-uptime-outpost/internal/metrics"
 	"vigilant-uptime-outpost/internal/registrar"
 )
 
+var (
+	batchSize          = metrics.NewHistogramVec("outpost_batch_size", "Number of checks in batch requests.", []float64{1, 2, 5, 10, 25, 50, 100, 250})
+	authFailures       = metrics.NewCounterVec("outpost_auth_failures_total", "Rejected requests by reason.", "reason")
+	tlsHandshakeErrors = metrics.NewCounterVec("outpost_tls_handshake_errors_total", "Failed TLS handshakes with clients.")
+	queueRejections    = metrics.NewCounterVec("outpost_queue_rejections_total", "Requests rejected because the check queue was full.")
+)
+
 type Server struct {
-	cfg           *config.Config
-	checker       *checks.Checker
-	registrar     *registrar.Registrar
-	server        *http.Server
-	lastRequest   time.Time
-	lastRequestMu sync.RWMutex
-	shutdownChan  chan struct{}
-	shutdownOnce  sync.Once
+	cfg            *config.Config
+	checker        *checks.Checker
+	registrar      *registrar.Registrar
+	callbackClient *http.Client
+	server         *http.Server
+	lastRequest    time.Time
+	lastRequestMu  sync.RWMutex
+	shutdownChan   chan struct{}
+	shutdownOnce   sync.Once
+	jobsCtx        context.Context
+	jobsCancel     context.CancelFunc
+	jobs           sync.WaitGroup
+	jobsMu         sync.Mutex
+	jobsClosed     bool
+	tlsMu          sync.Mutex
+	tlsMaterial    atomic.Pointer[tlsMaterial]
+	nonces         *nonceCache
 }
 
-func New(cfg *config.Config, c *checks.Checker, r *registrar.Registrar) *Server {
+func New(cfg *config.Config, c *checks.Checker, r *registrar.Registrar, policy *egress.Policy) *Server {
 	s := &Server{
-		cfg:          cfg,
-		checker:      c,
-		registrar:    r,
-		lastRequest:  time.Now(),
-		shutdownChan: make(chan struct{}),
+		cfg:            cfg,
+		checker:        c,
+		registrar:      r,
+		callbackClient: newCallbackClient(policy),
+		lastRequest:    time.Now(),
+		shutdownChan:   make(chan struct{}),
+		nonces:         newNonceCache(),
 	}
+	s.jobsCtx, s.jobsCancel = context.WithCancel(context.Background())
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.localhostOnly(s.health))
 	mux.HandleFunc("/run-check", s.requireAuth(s.trackActivity(s.runCheck)))
-	errorWriter := newTLSErrorLogWriter(s, os.Stderr)
+	mux.HandleFunc("/check-types", s.requireAuth(s.checkTypes))
+	mux.HandleFunc("/metrics", s.localhostOrAuth(s.metrics))
+	errorWriter := newTLSErrorLogWriter(s, logging.Writer(slog.LevelWarn))
 	s.server = &http.Server{
 		Addr:     ":" + strconv.Itoa(cfg.Port),
-		Handler:  mux,
-		ErrorLog: log.New(errorWriter, "", log.LstdFlags),
+		Handler:  withRequestID(mux),
+		ErrorLog: log.New(errorWriter, "", 0),
 	}
 	return s
 }
@@ -59,25 +86,27 @@ func (s *Server) Start() error {
 
 	// If we have certificates, start HTTPS server
 	if certData != nil && certData.Certificate != "" && certData.PrivateKey != "" {
-		log.Printf("starting HTTPS server on :%d", s.cfg.Port)
+		slog.Info("starting HTTPS server", "port", s.cfg.Port)
 
-		// Create certificate from PEM data
-		cert, err := tls.X509KeyPair([]byte(certData.Certificate), []byte(certData.PrivateKey))
+		tlsConfig, err := s.newTLSConfig()
 		if err != nil {
-			log.Printf("failed to load certificate: %v", err)
+			slog.Error("failed to configure TLS", "error", err)
 			return err
 		}
-
-		// Configure TLS
-		s.server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
+		s.server.TLSConfig = tlsConfig
+		if s.cfg.MTLSMode != config.MTLSOff {
+			slog.Info("client certificate verification enabled", "mode", s.cfg.MTLSMode)
 		}
 
 		return s.server.ListenAndServeTLS("", "")
 	}
 
+	if s.cfg.MTLSMode == config.MTLSRequire {
+		return fmt.Errorf("mTLS mode %q requires certificates from Vigilant", s.cfg.MTLSMode)
+	}
+
 	// Fall back to HTTP if no certificates
-	log.Printf("starting HTTP server on :%d", s.cfg.Port)
+	slog.Info("starting HTTP server", "port", s.cfg.Port)
 	return s.server.ListenAndServe()
 }
 
@@ -85,6 +114,24 @@ func (s *Server) Stop() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	s.server.Shutdown(ctx)
+
+	// Stop accepting background jobs from handlers that outlived Shutdown,
+	// so none is added while waiting. Give pending checks and callbacks a
+	// chance to finish, cancelling them only once the deadline has passed.
+	s.jobsMu.Lock()
+	s.jobsClosed = true
+	s.jobsMu.Unlock()
+	defer s.jobsCancel()
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("timed out waiting for background jobs, cancelling them")
+	}
 }
 
 func (s *Server) GetShutdownChan() <-chan struct{} {
@@ -93,7 +140,7 @@ func (s *Server) GetShutdownChan() <-chan struct{} {
 
 func (s *Server) requestShutdown(reason string) {
 	s.shutdownOnce.Do(func() {
-		log.Println(reason)
+		slog.Info(reason)
 		close(s.shutdownChan)
 	})
 }
@@ -127,24 +174,64 @@ func (s *Server) monitorInactivity() {
 
 func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// The TLS layer only accepts client certificates signed by the
+		// Vigilant root CA, so any verified chain identifies Vigilant.
+		hasClientCert := r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+		if s.cfg.MTLSMode == config.MTLSRequire && !hasClientCert {
+			authFailures.Inc("missing_client_certificate")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if hasClientCert && s.cfg.MTLSReplacesSecret {
+			next(w, r)
+			return
+		}
+
 		if s.cfg.OutpostSecret == "" {
 			next(w, r)
 			return
 		}
 
+		// Signed requests cannot be replayed, unlike the bearer token
+		if r.Header.Get(signatureHeader) != "" {
+			if err := s.verifySignature(r); err != nil {
+				switch {
+				case errors.Is(err, errStaleSignature):
+					authFailures.Inc("stale_signature")
+				case errors.Is(err, errReplayedNonce):
+					authFailures.Inc("replayed_nonce")
+				default:
+					authFailures.Inc("invalid_signature")
+				}
+				slog.WarnContext(r.Context(), "rejected signed request", "error", err)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+			return
+		}
+		if s.cfg.RequireSignature {
+			authFailures.Inc("missing_signature")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
+			authFailures.Inc("missing_token")
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
+			authFailures.Inc("malformed_token")
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		if parts[1] != s.cfg.OutpostSecret {
+		if subtle.ConstantTimeCompare([]byte(parts[1]), []byte(s.cfg.OutpostSecret)) != 1 {
+			authFailures.Inc("invalid_token")
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -153,6 +240,32 @@ func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// withRequestID tags the request context with the X-Request-ID header, or a
+// generated ID when absent, so that log lines can be correlated. The ID is
+// echoed in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newJobID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) localhostOnly(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		host, _, err := net.SplitHostPort(r.RemoteAddr)
@@ -171,10 +284,44 @@ func (s *Server) localhostOnly(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// localhostOrAuth serves loopback requests directly and requires
+// authentication from anywhere else.
+func (s *Server) localhostOrAuth(next http.HandlerFunc) http.HandlerFunc {
+	authed := s.requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				next(w, r)
+				return
+			}
+		}
+		authed(w, r)
+	}
+}
+
 func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+func (s *Server) checkTypes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checks.Types())
+}
+
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
+
 func (s *Server) runCheck(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "method not allowed", 405)
@@ -191,8 +338,25 @@ func (s *Server) runCheck(w http.ResponseWriter, r *http.Request) {
 	var jobs []checks.Job
 	if err := json.Unmarshal(body, &jobs); err == nil && len(jobs) > 0 {
 		// Handle batch request
-		results := s.runBatchChecks(r.Context(), jobs)
+		batchSize.Observe(float64(len(jobs)))
+		// A batch that could never be admitted as a whole is not retried
+		if capacity := s.checker.Capacity(); len(jobs) > capacity {
+			http.Error(w, fmt.Sprintf("batch of %d checks exceeds the limit of %d checks per batch", len(jobs), capacity), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err := s.checker.Admit(len(jobs)); err != nil {
+			s.rejectQueueFull(w, err)
+			return
+		}
+		if acceptsNDJSON(r) {
+			s.streamBatchChecks(w, r.Context(), jobs)
+			return
+		}
+		results, async := s.runBatchChecks(r.Context(), jobs)
 		w.Header().Set("Content-Type", "application/json")
+		if async == len(jobs) {
+			w.WriteHeader(http.StatusAccepted)
+		}
 		json.NewEncoder(w).Encode(results)
 		return
 	}
@@ -204,15 +368,49 @@ func (s *Server) runCheck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.checker.Admit(1); err != nil {
+		s.rejectQueueFull(w, err)
+		return
+	}
+
+	// Jobs with a callback are accepted immediately and reported later
+	if job.CallbackURL != "" {
+		result := s.dispatchAsync(r.Context(), job)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
 	// Run single check synchronously
 	result := s.checker.Run(r.Context(), job)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
-func (s *Server) runBatchChecks(ctx context.Context, jobs []checks.Job) []checks.Result {
+// rejectQueueFull asks the client to retry once queued checks had time to
+// complete.
+func (s *Server) rejectQueueFull(w http.ResponseWriter, err error) {
+	queueRejections.Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(queueFullRetryAfterSecs))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// runBatchChecks runs the synchronous jobs of a batch concurrently and
+// dispatches jobs with a callback URL to the background. It returns the
+// results in job order along with the number of dispatched jobs.
+func (s *Server) runBatchChecks(ctx context.Context, jobs []checks.Job) ([]checks.Result, int) {
 	results := make([]checks.Result, len(jobs))
+	async := s.runBatch(ctx, jobs, func(index int, result checks.Result) {
+		results[index] = result
+	})
+	return results, async
+}
 
+// runBatch runs a batch like runBatchChecks, but hands each result to emit
+// with its index as soon as it is available. emit is called from the
+// calling goroutine, pending results of dispatched jobs first.
+func (s *Server) runBatch(ctx context.Context, jobs []checks.Job, emit func(index int, result checks.Result)) int {
 	// Use a channel to collect results from concurrent checks
 	type indexedResult struct {
 		index  int
@@ -221,7 +419,13 @@ func (s *Server) runBatchChecks(ctx context.Context, jobs []checks.Job) []checks
 	resultChan := make(chan indexedResult, len(jobs))
 
 	// Run all checks concurrently
+	async := 0
 	for i, job := range jobs {
+		if job.CallbackURL != "" {
+			emit(i, s.dispatchAsync(ctx, job))
+			async++
+			continue
+		}
 		go func(idx int, j checks.Job) {
 			resultChan <- indexedResult{
 				index:  idx,
@@ -231,16 +435,24 @@ func (s *Server) runBatchChecks(ctx context.Context, jobs []checks.Job) []checks
 	}
 
 	// Collect results
-	for range jobs {
+	for range len(jobs) - async {
 		ir := <-resultChan
-		results[ir.index] = ir.result
+		emit(ir.index, ir.result)
 	}
 
-	return results
+	return async
 }
 
+const (
+	requestIDHeader = "X-Request-ID"
+
+	// queueFullRetryAfterSecs is sent as Retry-After when the queue is full
+	queueFullRetryAfterSecs = 5
+)
+
 const (
 	badRecordMACError = "tls: bad record MAC"
+	tlsHandshakeError = "TLS handshake error"
 	tlsErrorThreshold = 3
 	tlsErrorWindow    = 30 * time.Second
 )
@@ -262,6 +474,9 @@ func newTLSErrorLogWriter(server *Server, target io.Writer) *tlsErrorLogWriter {
 }
 
 func (w *tlsErrorLogWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte(tlsHandshakeError)) {
+		tlsHandshakeErrors.Inc()
+	}
 	if w.shouldTriggerRestart(p) {
 		w.server.requestShutdown("detected repeated TLS handshake failures (bad record MAC), requesting restart")
 	}
@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxSignedBodyBytes bounds the request bodies read for signature
+// verification.
+const maxSignedBodyBytes = 10 << 20
+
+var (
+	errStaleSignature = errors.New("signature timestamp outside the allowed window")
+	errReplayedNonce  = errors.New("signature nonce already used")
+	errBadSignature   = errors.New("invalid signature")
+)
+
+// verifySignature checks a request signed by Vigilant with the scheme used
+// for callbacks: X-Signature holds the HMAC-SHA256 of the request label,
+// method, request URI, X-Signature-Timestamp, X-Signature-Nonce and the body. The
+// body is restored for the handler.
+func (s *Server) verifySignature(r *http.Request) error {
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	nonce := r.Header.Get(signatureNonceHeader)
+	signature := r.Header.Get(signatureHeader)
+	if timestamp == "" || nonce == "" || len(nonce) > 128 {
+		return errBadSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errBadSignature
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > s.signatureWindow() {
+		return errStaleSignature
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	if len(body) > maxSignedBodyBytes {
+		return errBadSignature
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := signPayload(s.cfg.OutpostSecret, signatureRequestLabel, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errBadSignature
+	}
+
+	// Only remember nonces of valid signatures, so that the cache cannot be
+	// filled by unauthenticated clients
+	if !s.nonces.add(nonce, time.Unix(unix, 0).Add(s.signatureWindow())) {
+		return errReplayedNonce
+	}
+	return nil
+}
+
+func (s *Server) signatureWindow() time.Duration {
+	return time.Duration(s.cfg.SignatureMaxSkewSecs) * time.Second
+}
+
+// nonceCache remembers the nonces of signed requests until their timestamp
+// falls outside the allowed window, after which the request would be
+// rejected anyway.
+type nonceCache struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{expires: make(map[string]time.Time)}
+}
+
+// add records the nonce until expiry. It returns false when the nonce was
+// already used.
+func (c *nonceCache) add(nonce string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPrune) > time.Minute {
+		for n, exp := range c.expires {
+			if now.After(exp) {
+				delete(c.expires, n)
+			}
+		}
+		c.lastPrune = now
+	}
+
+	if exp, ok := c.expires[nonce]; ok && !now.After(exp) {
+		return false
+	}
+	c.expires[nonce] = expiry
+	return true
+}
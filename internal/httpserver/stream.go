@@ -0,0 +1,64 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"vigilant-uptime-outpost/internal/checks"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// acceptsNDJSON reports whether the client asked for results to be streamed
+// as newline-delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if mediaType == ndjsonContentType || mediaType == "application/ndjson" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamedResult tags a result with the position of its job in the batch,
+// as streamed results arrive in completion order.
+type streamedResult struct {
+	Index int `json:"index"`
+	checks.Result
+}
+
+// streamBatchChecks runs a batch and writes each result as a JSON line as
+// soon as it completes.
+func (s *Server) streamBatchChecks(w http.ResponseWriter, ctx context.Context, jobs []checks.Job) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	failed := false
+	s.runBatch(ctx, jobs, func(index int, result checks.Result) {
+		if failed {
+			return
+		}
+		if err := enc.Encode(streamedResult{Index: index, Result: result}); err != nil {
+			slog.WarnContext(ctx, "failed to stream result", "error", err)
+			failed = true
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			slog.WarnContext(ctx, "failed to flush streamed result", "error", err)
+			failed = true
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+
+	"vigilant-uptime-outpost/internal/config"
+	"vigilant-uptime-outpost/internal/registrar"
+)
+
+// tlsMaterial caches the TLS configuration built from a set of certificates
+// issued by Vigilant.
+type tlsMaterial struct {
+	source *registrar.RegistrationResponse
+	config *tls.Config
+}
+
+// newTLSConfig returns the server TLS configuration. Certificates are looked
+// up on every handshake so that renewed certificates are served without a
+// restart.
+func (s *Server) newTLSConfig() (*tls.Config, error) {
+	// Fail early when the initial certificates are unusable
+	if _, err := s.currentTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.currentTLSConfig()
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cfg, err := s.currentTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			return &cfg.Certificates[0], nil
+		},
+	}, nil
+}
+
+// currentTLSConfig returns the configuration for the current certificates,
+// rebuilding it when the registrar has renewed them. When new certificates
+// cannot be loaded, the previous configuration is kept.
+func (s *Server) currentTLSConfig() (*tls.Config, error) {
+	certData := s.registrar.GetCertificates()
+	if current := s.tlsMaterial.Load(); current != nil && current.source == certData {
+		return current.config, nil
+	}
+
+	s.tlsMu.Lock()
+	defer s.tlsMu.Unlock()
+
+	current := s.tlsMaterial.Load()
+	if current != nil && current.source == certData {
+		return current.config, nil
+	}
+
+	cfg, err := s.buildTLSConfig(certData)
+	if err != nil {
+		if current == nil {
+			return nil, err
+		}
+		slog.Error("failed to load renewed certificate, keeping the current one", "error", err)
+		s.tlsMaterial.Store(&tlsMaterial{source: certData, config: current.config})
+		return current.config, nil
+	}
+
+	if current != nil {
+		slog.Info("loaded renewed certificate")
+	}
+	s.tlsMaterial.Store(&tlsMaterial{source: certData, config: cfg})
+	return cfg, nil
+}
+
+func (s *Server) buildTLSConfig(certData *registrar.RegistrationResponse) (*tls.Config, error) {
+	if certData == nil {
+		return nil, fmt.Errorf("no certificates available")
+	}
+
+	// Create certificate from PEM data
+	cert, err := tls.X509KeyPair([]byte(certData.Certificate), []byte(certData.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	// The configuration replaces the server's own for every handshake, so
+	// it has to offer HTTP/2 like http.Server does by default
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if s.cfg.MTLSMode != config.MTLSOff {
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM([]byte(certData.RootCertificate)) {
+			return nil, fmt.Errorf("mTLS mode %q requires a valid root certificate from Vigilant", s.cfg.MTLSMode)
+		}
+		// Certificates are verified whenever presented, requiring them is
+		// enforced per endpoint so that /health keeps working locally.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,88 @@
+// Package logging configures structured logging with log/slog and carries
+// correlation IDs through contexts so that every line logged while handling a
+// request or job can be tied back to it.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	jobIDKey
+)
+
+// Setup installs the default logger. format is "json" or "text". Output of
+// the standard log package is routed through the same handler.
+func Setup(level slog.Level, format string) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// WithRequestID returns a context whose log lines carry the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID stored in ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithJobID returns a context whose log lines carry the job ID.
+func WithJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey, id)
+}
+
+// contextHandler adds the correlation IDs found in the context to each
+// record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id, _ := ctx.Value(jobIDKey).(string); id != "" {
+		r.AddAttrs(slog.String("job_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Writer returns a writer that logs each write as a message at the given
+// level, for components that only accept an io.Writer.
+func Writer(level slog.Level) io.Writer {
+	return levelWriter{level}
+}
+
+type levelWriter struct {
+	level slog.Level
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	slog.Log(context.Background(), w.level, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,230 @@
+// Package puller runs checks for outposts that Vigilant cannot reach. Instead
+// of listening for incoming requests, the outpost long-polls Vigilant for jobs
+// and posts the results back.
+package puller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"vigilant-uptime-outpost/internal/checks"
+	"vigilant-uptime-outpost/internal/config"
+	"vigilant-uptime-outpost/internal/logging"
+	"vigilant-uptime-outpost/internal/registrar"
+)
+
+const (
+	jobsPath    = "/api/v1/outposts/jobs"
+	resultsPath = "/api/v1/outposts/results"
+
+	pollInitialBackoff = time.Second
+	pollMaxBackoff     = time.Minute
+
+	resultMaxAttempts    = 5
+	resultInitialBackoff = time.Second
+	resultMaxBackoff     = 30 * time.Second
+
+	// drainTimeout bounds how long running jobs may take to report their
+	// results once polling stops
+	drainTimeout = 5 * time.Second
+)
+
+type Puller struct {
+	cfg       *config.Config
+	checker   *checks.Checker
+	registrar *registrar.Registrar
+	slots     chan struct{}
+	jobs      sync.WaitGroup
+}
+
+func New(cfg *config.Config, c *checks.Checker, r *registrar.Registrar) *Puller {
+	return &Puller{
+		cfg:       cfg,
+		checker:   c,
+		registrar: r,
+		slots:     make(chan struct{}, cfg.MaxConcurrency),
+	}
+}
+
+// Run polls Vigilant for jobs until ctx is canceled, then waits up to
+// drainTimeout for running jobs to report their results. Jobs run detached
+// from ctx so that canceling it only stops polling.
+func (p *Puller) Run(ctx context.Context) {
+	if p.cfg.VigilantURL == "" {
+		slog.Warn("VIGILANT_URL not set, not polling for jobs")
+		return
+	}
+	slog.Info("polling Vigilant for jobs", "vigilant_url", p.cfg.VigilantURL)
+
+	jobsCtx, jobsCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer p.drain(jobsCancel)
+
+	backoff := pollInitialBackoff
+	for ctx.Err() == nil {
+		// Only ask for as many jobs as can be started right away
+		free := cap(p.slots) - len(p.slots)
+		if free == 0 {
+			// Wait for a running job to finish
+			select {
+			case <-ctx.Done():
+				return
+			case p.slots <- struct{}{}:
+				<-p.slots
+			}
+			continue
+		}
+
+		jobs, err := p.poll(ctx, free)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("error polling Vigilant for jobs", "error", err, "retry_in", backoff.String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+				if backoff < pollMaxBackoff {
+					backoff *= 2
+				}
+			}
+			continue
+		}
+		backoff = pollInitialBackoff
+
+		for _, job := range jobs {
+			p.slots <- struct{}{}
+			p.jobs.Add(1)
+			go func(job checks.Job) {
+				defer p.jobs.Done()
+				defer func() { <-p.slots }()
+				p.runJob(jobsCtx, job)
+			}(job)
+		}
+	}
+}
+
+// drain waits for running jobs to finish, canceling them once drainTimeout
+// has passed.
+func (p *Puller) drain(cancel context.CancelFunc) {
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		p.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		slog.Warn("timed out waiting for pulled jobs, cancelling them")
+		cancel()
+		<-done
+	}
+}
+
+// poll waits up to PullWaitSecs for Vigilant to hand out at most max jobs. An
+// empty slice is returned when no jobs are available.
+func (p *Puller) poll(ctx context.Context, max int) ([]checks.Job, error) {
+	query := url.Values{}
+	query.Set("outpost_id", p.cfg.OutpostID)
+	query.Set("max", strconv.Itoa(max))
+	query.Set("wait", strconv.Itoa(p.cfg.PullWaitSecs))
+
+	// Allow Vigilant to hold the request for the full wait period
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(p.cfg.PullWaitSecs)*time.Second+30*time.Second)
+	defer cancel()
+
+	resp, err := p.registrar.Do(ctx, "GET", jobsPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil, nil
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var jobs []checks.Job
+	if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+		return nil, fmt.Errorf("failed to parse jobs: %w", err)
+	}
+	if len(jobs) > max {
+		slog.Warn("Vigilant sent more jobs than requested, dropping the rest", "received", len(jobs), "requested", max)
+		jobs = jobs[:max]
+	}
+	return jobs, nil
+}
+
+func (p *Puller) runJob(ctx context.Context, job checks.Job) {
+	if job.ID == "" {
+		slog.WarnContext(ctx, "ignoring job without an ID", "type", job.Type, "target", job.Target)
+		return
+	}
+	ctx = logging.WithJobID(ctx, job.ID)
+
+	var result checks.Result
+	if err := p.checker.Admit(1); err != nil {
+		result = checks.Result{
+			Outpost: p.registrar.Info(), JobID: job.ID, Type: job.Type, Target: job.Target,
+			Error: err.Error(), Timestamp: time.Now().UTC(),
+		}
+	} else {
+		result = p.checker.Run(ctx, job)
+	}
+	if err := p.postResult(ctx, result); err != nil {
+		slog.ErrorContext(ctx, "reporting result failed", "error", err)
+	}
+}
+
+// postResult sends the result to Vigilant, retrying with exponential backoff
+// until it is accepted or the attempts run out.
+func (p *Puller) postResult(ctx context.Context, result checks.Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	backoff := resultInitialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= resultMaxAttempts; attempt++ {
+		lastErr = p.sendResult(ctx, body)
+		if lastErr == nil {
+			return nil
+		}
+		if attempt == resultMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			if backoff < resultMaxBackoff {
+				backoff *= 2
+			}
+		}
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", resultMaxAttempts, lastErr)
+}
+
+func (p *Puller) sendResult(ctx context.Context, body []byte) error {
+	resp, err := p.registrar.Do(ctx, "POST", resultsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package registrar
+
+import "encoding/json"
+
+// Capabilities tells Vigilant which jobs the outpost is able to run.
+type Capabilities struct {
+	Version        string          `json:"version"`
+	CheckTypes     []CheckTypeInfo `json:"check_types"`
+	IPv4           bool            `json:"ipv4"`
+	IPv6           bool            `json:"ipv6"`
+	ICMP           bool            `json:"icmp"`
+	MaxConcurrency int             `json:"max_concurrency"`
+}
+
+// CheckTypeInfo describes a supported check type and the JSON schema of its
+// options.
+type CheckTypeInfo struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description"`
+	Options     json.RawMessage `json:"options,omitempty"`
+}
+
+// SetCapabilities sets the capabilities advertised when registering. It
+// must be called before Register.
+func (r *Registrar) SetCapabilities(c Capabilities) {
+	r.capabilities = &c
+}
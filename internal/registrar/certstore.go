@@ -0,0 +1,112 @@
+package registrar
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	certificateFile     = "certificate.pem"
+	privateKeyFile      = "private_key.pem"
+	rootCertificateFile = "root_certificate.pem"
+)
+
+// loadStoredCertificates returns the certificates persisted in the data
+// directory when they are still valid, or nil otherwise.
+func (r *Registrar) loadStoredCertificates() *RegistrationResponse {
+	if r.cfg.DataDir == "" {
+		return nil
+	}
+
+	certPEM, err := os.ReadFile(filepath.Join(r.cfg.DataDir, certificateFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("failed to read stored certificate", "error", err)
+		}
+		return nil
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(r.cfg.DataDir, privateKeyFile))
+	if err != nil {
+		slog.Warn("failed to read stored private key", "error", err)
+		return nil
+	}
+	rootPEM, err := os.ReadFile(filepath.Join(r.cfg.DataDir, rootCertificateFile))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("failed to read stored root certificate", "error", err)
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		slog.Warn("ignoring stored certificate", "error", err)
+		return nil
+	}
+	cert, err := parseCertificate(string(certPEM))
+	if err != nil {
+		slog.Warn("ignoring stored certificate", "error", err)
+		return nil
+	}
+	if time.Now().After(cert.NotAfter) {
+		slog.Info("ignoring expired stored certificate", "not_after", cert.NotAfter.Format(time.RFC3339))
+		return nil
+	}
+
+	slog.Info("loaded stored certificate", "not_after", cert.NotAfter.Format(time.RFC3339))
+	return &RegistrationResponse{
+		Certificate:     string(certPEM),
+		PrivateKey:      string(keyPEM),
+		RootCertificate: string(rootPEM),
+	}
+}
+
+// storeCertificates persists the certificates in the data directory. The
+// private key is only readable by the outpost user.
+func (r *Registrar) storeCertificates(certData *RegistrationResponse) {
+	if r.cfg.DataDir == "" || certData == nil || certData.Certificate == "" {
+		return
+	}
+
+	files := []struct {
+		name string
+		data string
+		perm os.FileMode
+	}{
+		{privateKeyFile, certData.PrivateKey, 0600},
+		{certificateFile, certData.Certificate, 0644},
+		{rootCertificateFile, certData.RootCertificate, 0644},
+	}
+	for _, f := range files {
+		if err := writeFileAtomic(filepath.Join(r.cfg.DataDir, f.name), []byte(f.data), f.perm); err != nil {
+			slog.Error("failed to store certificate file", "file", f.name, "error", err)
+			return
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it into place
+// so that a crash never leaves a partially written file behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", filepath.Base(path), err)
+	}
+	return nil
+}
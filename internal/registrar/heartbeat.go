@@ -0,0 +1,140 @@
+package registrar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"time"
+
+	"vigilant-uptime-outpost/internal/version"
+)
+
+// errUnknownOutpost is returned when Vigilant no longer knows the outpost,
+// for example after its registration expired.
+var errUnknownOutpost = errors.New("outpost unknown to Vigilant")
+
+// CheckStats summarizes the checks run since the outpost started.
+type CheckStats struct {
+	InFlight int64 `json:"in_flight"`
+	Run      int64 `json:"run"`
+	Failed   int64 `json:"failed"`
+	Errors   int64 `json:"errors"`
+}
+
+// ResourceUsage describes the resources used by the outpost process.
+type ResourceUsage struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapAllocBytes uint64 `json:"heap_alloc_bytes"`
+	SysBytes       uint64 `json:"sys_bytes"`
+	NumGC          uint32 `json:"num_gc"`
+	NumCPU         int    `json:"num_cpu"`
+}
+
+type Heartbeat struct {
+	OutpostID     string        `json:"outpost_id,omitempty"`
+	IP            string        `json:"ip"`
+	Port          int           `json:"port"`
+	Version       string        `json:"version"`
+	UptimeSeconds int64         `json:"uptime_seconds"`
+	Checks        CheckStats    `json:"checks"`
+	Resources     ResourceUsage `json:"resources"`
+	Timestamp     time.Time     `json:"timestamp"`
+}
+
+// SetStatsProvider sets the function reporting check counters in
+// heartbeats. It must be called before RunHeartbeat.
+func (r *Registrar) SetStatsProvider(stats func() CheckStats) {
+	r.stats = stats
+}
+
+// RunHeartbeat reports the outpost status to Vigilant every
+// HeartbeatIntervalSecs until ctx is canceled. When Vigilant replies that the
+// outpost is unknown, the outpost registers itself again.
+func (r *Registrar) RunHeartbeat(ctx context.Context) {
+	if r.cfg.VigilantURL == "" || r.cfg.HeartbeatIntervalSecs <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(r.cfg.HeartbeatIntervalSecs) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := r.sendHeartbeat(ctx)
+		if errors.Is(err, errUnknownOutpost) {
+			slog.Warn("Vigilant does not know this outpost, registering again")
+			err = r.reregister(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("heartbeat to Vigilant failed", "error", err)
+		}
+	}
+}
+
+func (r *Registrar) heartbeat() Heartbeat {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	hb := Heartbeat{
+		OutpostID:     r.cfg.OutpostID,
+		IP:            r.cfg.IP,
+		Port:          r.cfg.Port,
+		Version:       version.Version,
+		UptimeSeconds: int64(time.Since(r.started).Seconds()),
+		Resources: ResourceUsage{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAllocBytes: mem.HeapAlloc,
+			SysBytes:       mem.Sys,
+			NumGC:          mem.NumGC,
+			NumCPU:         runtime.NumCPU(),
+		},
+		Timestamp: time.Now().UTC(),
+	}
+	if r.stats != nil {
+		hb.Checks = r.stats()
+	}
+	return hb
+}
+
+func (r *Registrar) sendHeartbeat(ctx context.Context) error {
+	body, _ := json.Marshal(r.heartbeat())
+
+	resp, err := r.Do(ctx, "POST", "/api/v1/outposts/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errUnknownOutpost
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// reregister registers the outpost again after Vigilant lost track of it,
+// keeping the current certificates when no new ones are issued.
+func (r *Registrar) reregister(ctx context.Context) error {
+	regResp, err := r.register(ctx)
+	if err != nil {
+		return fmt.Errorf("re-registration failed: %w", err)
+	}
+	if regResp != nil && regResp.Certificate != "" {
+		r.setCertificates(regResp)
+		slog.Info("received certificates from Vigilant")
+	}
+	slog.Info("registered with Vigilant again", "url", r.registerURL())
+	return nil
+}
@@ -5,14 +5,20 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"vigilant-uptime-outpost/internal/config"
+	"vigilant-uptime-outpost/internal/metrics"
 )
 
+var registrationAttempts = metrics.NewCounterVec("outpost_registration_attempts_total", "Registration attempts with Vigilant by result (success or failure).", "result")
+
 var httpClient = &http.Client{
 	Transport: &http.Transport{
 		TLSClientConfig: &tls.Config{
@@ -22,12 +28,17 @@ var httpClient = &http.Client{
 }
 
 type Registration struct {
+	OutpostID string  `json:"outpost_id,omitempty"`
+	Mode      string  `json:"mode,omitempty"`
 	IP        string  `json:"ip"`
 	Port      int     `json:"port"`
 	Hostname  string  `json:"hostname"`
 	Country   string  `json:"country,omitempty"`
 	Latitude  float64 `json:"latitude,omitempty"`
 	Longitude float64 `json:"longitude,omitempty"`
+
+	Labels       map[string]string `json:"labels,omitempty"`
+	Capabilities *Capabilities     `json:"capabilities,omitempty"`
 }
 
 type RegistrationResponse struct {
@@ -38,15 +49,24 @@ type RegistrationResponse struct {
 
 type Registrar struct {
 	cfg      *config.Config
+	certMu   sync.RWMutex
 	certData *RegistrationResponse
+	started  time.Time
+	stats    func() CheckStats
+
+	capabilities *Capabilities
 }
 
 func New(cfg *config.Config) *Registrar {
-	return &Registrar{cfg: cfg}
+	r := &Registrar{cfg: cfg, started: time.Now()}
+	// Reuse certificates from a previous run until Vigilant issues new ones
+	r.certData = r.loadStoredCertificates()
+	return r
 }
 
 func (r *Registrar) Info() Registration {
 	return Registration{
+		OutpostID: r.cfg.OutpostID,
 		IP:        r.cfg.IP,
 		Port:      r.cfg.Port,
 		Hostname:  r.cfg.Hostname,
@@ -56,56 +76,44 @@ func (r *Registrar) Info() Registration {
 	}
 }
 
+// GetCertificates returns the current certificate material. The returned
+// value is replaced, never modified, when certificates are renewed.
 func (r *Registrar) GetCertificates() *RegistrationResponse {
+	r.certMu.RLock()
+	defer r.certMu.RUnlock()
 	return r.certData
 }
 
+func (r *Registrar) setCertificates(certData *RegistrationResponse) {
+	r.certMu.Lock()
+	r.certData = certData
+	r.certMu.Unlock()
+	r.storeCertificates(certData)
+}
+
 func (r *Registrar) Register(ctx context.Context) error {
 	if r.cfg.VigilantURL == "" {
-		log.Println("VIGILANT_URL not set, skipping registration")
+		slog.Warn("VIGILANT_URL not set, skipping registration")
 		return nil
 	}
-	log.Printf("registering with Vigilant at %s", r.cfg.VigilantURL)
-	url := strings.TrimRight(r.cfg.VigilantURL, "/") + "/api/v1/outposts/register"
-	registration := Registration{
-		IP:        r.cfg.IP,
-		Port:      r.cfg.Port,
-		Country:   r.cfg.Country,
-		Latitude:  r.cfg.Latitude,
-		Longitude: r.cfg.Longitude,
-	}
-	body, _ := json.Marshal(registration)
+	slog.Info("registering with Vigilant", "vigilant_url", r.cfg.VigilantURL)
+	url := r.registerURL()
 
 	backoff := time.Second
 	for {
-		log.Printf("attempting to register with Vigilant at %s", url)
-		req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", "Vigilant Bot")
-		if r.cfg.OutpostSecret != "" {
-			req.Header.Set("Authorization", "Bearer "+r.cfg.OutpostSecret)
-		}
-		resp, err := httpClient.Do(req)
-		if err == nil && resp.StatusCode < 300 {
-			// Parse the response to get certificates
-			var regResp RegistrationResponse
-			if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
-				resp.Body.Close()
-				log.Printf("failed to parse registration response: %v", err)
-			} else {
-				r.certData = &regResp
-				log.Printf("received certificates from Vigilant")
+		slog.Debug("attempting to register with Vigilant", "url", url)
+		regResp, err := r.register(ctx)
+		if err == nil {
+			if regResp != nil && regResp.Certificate != "" {
+				r.setCertificates(regResp)
+				slog.Info("received certificates from Vigilant")
+			} else if r.GetCertificates() != nil {
+				slog.Info("no certificates received from Vigilant, using stored certificates")
 			}
-			resp.Body.Close()
-			log.Printf("registered with Vigilant at %s", url)
+			slog.Info("registered with Vigilant", "url", url)
 			return nil
 		}
-		if resp != nil {
-			log.Printf("error registering with Vigilant at %s: %v %s", url, err, resp.Status)
-			resp.Body.Close()
-		} else {
-			log.Printf("error registering with Vigilant at %s: %v", url, err)
-		}
+		slog.Warn("error registering with Vigilant", "url", url, "error", err, "retry_in", backoff.String())
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
@@ -117,15 +125,87 @@ func (r *Registrar) Register(ctx context.Context) error {
 	}
 }
 
+func (r *Registrar) registerURL() string {
+	return strings.TrimRight(r.cfg.VigilantURL, "/") + "/api/v1/outposts/register"
+}
+
+// register performs a single registration request. It returns the issued
+// certificates, or nil when the response could not be parsed.
+func (r *Registrar) register(ctx context.Context) (*RegistrationResponse, error) {
+	regResp, err := r.doRegister(ctx)
+	if err != nil {
+		registrationAttempts.Inc("failure")
+	} else {
+		registrationAttempts.Inc("success")
+	}
+	return regResp, err
+}
+
+func (r *Registrar) doRegister(ctx context.Context) (*RegistrationResponse, error) {
+	registration := Registration{
+		OutpostID: r.cfg.OutpostID,
+		Mode:      r.cfg.Mode,
+		IP:        r.cfg.IP,
+		Port:      r.cfg.Port,
+		Country:   r.cfg.Country,
+		Latitude:  r.cfg.Latitude,
+		Longitude: r.cfg.Longitude,
+
+		Labels:       r.cfg.Labels,
+		Capabilities: r.capabilities,
+	}
+	body, _ := json.Marshal(registration)
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", r.registerURL(), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Vigilant Bot")
+	if r.cfg.OutpostSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.OutpostSecret)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Parse the response to get certificates
+	var regResp RegistrationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
+		slog.Warn("failed to parse registration response", "error", err)
+		return nil, nil
+	}
+	return &regResp, nil
+}
+
+// Do sends an authenticated request to the given path of the Vigilant API.
+func (r *Registrar) Do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	url := strings.TrimRight(r.cfg.VigilantURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("User-Agent", "Vigilant Bot")
+	if r.cfg.OutpostSecret != "" {
+		req.Header.Set("Authorization", "Bearer "+r.cfg.OutpostSecret)
+	}
+	return httpClient.Do(req)
+}
+
 func (r *Registrar) Unregister(ctx context.Context) error {
 	if r.cfg.VigilantURL == "" {
-		log.Println("VIGILANT_URL not set, skipping unregistration")
+		slog.Warn("VIGILANT_URL not set, skipping unregistration")
 		return nil
 	}
-	log.Printf("unregistering from Vigilant at %s", r.cfg.VigilantURL)
+	slog.Info("unregistering from Vigilant", "vigilant_url", r.cfg.VigilantURL)
 	url := strings.TrimRight(r.cfg.VigilantURL, "/") + "/api/v1/outposts/unregister"
 	body, _ := json.Marshal(Registration{
-		IP: r.cfg.IP, Port: r.cfg.Port,
+		OutpostID: r.cfg.OutpostID, IP: r.cfg.IP, Port: r.cfg.Port,
 	})
 
 	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
@@ -136,14 +216,14 @@ func (r *Registrar) Unregister(ctx context.Context) error {
 	}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Printf("error unregistering from Vigilant at %s: %v", url, err)
+		slog.Error("error unregistering from Vigilant", "url", url, "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		log.Printf("error unregistering from Vigilant at %s: status %s", url, resp.Status)
+		slog.Error("error unregistering from Vigilant", "url", url, "status", resp.Status)
 		return nil
 	}
-	log.Printf("unregistered from Vigilant at %s", url)
+	slog.Info("unregistered from Vigilant", "url", url)
 	return nil
 }
@@ -0,0 +1,111 @@
+package registrar
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	renewRetryInitialBackoff = time.Minute
+	renewRetryMaxBackoff     = time.Hour
+)
+
+// RunCertificateRenewal requests a fresh certificate from Vigilant ahead of
+// the current one expiring, until ctx is canceled. Renewed certificates are
+// picked up through GetCertificates.
+func (r *Registrar) RunCertificateRenewal(ctx context.Context) {
+	if r.cfg.VigilantURL == "" {
+		return
+	}
+
+	for {
+		certData := r.GetCertificates()
+		if certData == nil || certData.Certificate == "" {
+			slog.Info("no certificate to renew, certificate renewal disabled")
+			return
+		}
+
+		renewAt, notAfter, err := r.renewalTime(certData.Certificate)
+		if err != nil {
+			slog.Error("failed to parse certificate, certificate renewal disabled", "error", err)
+			return
+		}
+		slog.Info("scheduled certificate renewal", "not_after", notAfter.Format(time.RFC3339), "renew_at", renewAt.Format(time.RFC3339))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(renewAt)):
+		}
+
+		if err := r.renewCertificates(ctx, notAfter); err != nil {
+			return
+		}
+	}
+}
+
+// renewCertificates retries registration until a new certificate is issued.
+// It only returns an error when ctx is canceled.
+func (r *Registrar) renewCertificates(ctx context.Context, notAfter time.Time) error {
+	backoff := renewRetryInitialBackoff
+	for {
+		slog.Info("renewing certificate with Vigilant", "vigilant_url", r.cfg.VigilantURL)
+		regResp, err := r.register(ctx)
+		if err == nil && regResp != nil && regResp.Certificate != "" {
+			if _, newNotAfter, parseErr := r.renewalTime(regResp.Certificate); parseErr != nil {
+				err = parseErr
+			} else if !newNotAfter.After(notAfter) {
+				err = errors.New("received certificate does not expire later than the current one")
+			} else {
+				r.setCertificates(regResp)
+				slog.Info("renewed certificate", "not_after", newNotAfter.Format(time.RFC3339))
+				return nil
+			}
+		} else if err == nil {
+			err = errors.New("no certificate in registration response")
+		}
+
+		slog.Warn("certificate renewal failed", "error", err, "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			if backoff < renewRetryMaxBackoff {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// renewalTime returns when the certificate should be renewed along with its
+// expiry. Renewal happens CertRenewBeforeHours before expiry when configured,
+// otherwise once two thirds of the validity period have passed.
+func (r *Registrar) renewalTime(certPEM string) (time.Time, time.Time, error) {
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	var renewAt time.Time
+	if r.cfg.CertRenewBeforeHours > 0 {
+		renewAt = cert.NotAfter.Add(-time.Duration(r.cfg.CertRenewBeforeHours) * time.Hour)
+	} else {
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+		renewAt = cert.NotBefore.Add(lifetime * 2 / 3)
+	}
+	return renewAt, cert.NotAfter, nil
+}
+
+// parseCertificate decodes the first certificate of a PEM bundle.
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,6 @@
+// Package version holds the build version of the outpost.
+package version
+
+// Version is set at build time with
+// -ldflags "-X vigilant-uptime-outpost/internal/version.Version=<version>".
+var Version = "dev"